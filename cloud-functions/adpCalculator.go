@@ -2,13 +2,20 @@ package cloudfunctions
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"sync"
+	"os"
+	"strconv"
 	"time"
 
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/metrics"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
 	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
 )
 
 type LeagueUser struct {
@@ -27,6 +34,8 @@ type League struct {
 	DraftType    string       `json:"draftType" firestore:"DraftType"`
 	Level        string       `json:"level" firestore:"Level"`
 	IsLocked     bool         `json:"isLocked" firestore:"IsLocked"`
+	// set when the league did not fill by its StartDate and its users were refunded
+	IsCancelled bool `json:"isCancelled" firestore:"IsCancelled"`
 }
 
 type PlayerInfo struct {
@@ -52,6 +61,8 @@ type DraftSummary struct {
 
 type DraftPositionTracker struct {
 	Players map[string][]int `json:"players"`
+	// cards drafted across the leagues read, which DraftRate is a share of
+	Cards int `json:"cards"`
 }
 
 type PickInfo struct {
@@ -66,98 +77,231 @@ type PickInfo struct {
 // 	}
 // }
 
+type ADPChange struct {
+	PlayerId  string  `json:"playerId"`
+	ADPBefore float64 `json:"adpBefore"`
+	ADPAfter  float64 `json:"adpAfter"`
+}
+
+type LeagueFailure struct {
+	LeagueId string `json:"leagueId"`
+	Error    string `json:"error"`
+}
+
+type ADPSummary struct {
+	DryRun           bool            `json:"dryRun"`
+	LeaguesProcessed int             `json:"leaguesProcessed"`
+	LeaguesSkipped   int             `json:"leaguesSkipped"`
+	LeaguesFailed    int             `json:"leaguesFailed"`
+	CardsDrafted     int             `json:"cardsDrafted"`
+	FailedLeagues    []LeagueFailure `json:"failedLeagues"`
+	Changes          []ADPChange     `json:"changes"`
+	Cancelled        bool            `json:"cancelled,omitempty"`
+	Error            string          `json:"error,omitempty"`
+}
+
+// leagueResult is what a league worker hands to the aggregator: the picks of
+// a locked league, a skip for an unlocked one, or the error that stopped it
+type leagueResult struct {
+	LeagueId string
+	Picks    []PickInfo
+	Cards    int
+	Skipped  bool
+	Err      error
+}
+
 func CalculateADP(w http.ResponseWriter, r *http.Request) {
-	res, err := utils.Db.Client.Collection("drafts").Documents(context.Background()).GetAll()
+	ctx, cancel := utils.JobContext(r.Context())
+	defer cancel()
+
+	summary, err := ComputeADP(ctx, isDryRun(r))
+	if errors.Is(err, utils.ErrLockHeld) {
+		logging.FromContext(ctx).Warn("adp is already being calculated", "error", err)
+		summary.Error = err.Error()
+		writeJSON(ctx, w, http.StatusConflict, summary)
+		return
+	}
+	if err != nil && ctx.Err() != nil {
+		logging.FromContext(ctx).Warn("adp calculation was cancelled before it finished", "processed", summary.LeaguesProcessed, "error", err)
+		summary.Cancelled = true
+		summary.Error = err.Error()
+		writeJSON(ctx, w, http.StatusGatewayTimeout, summary)
+		return
+	}
 	if err != nil {
-		fmt.Println("error reading all league documents: ", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.FromContext(ctx).Error("error calculating adp", "error", err)
+		summary.Error = err.Error()
+		writeJSON(ctx, w, http.StatusInternalServerError, summary)
 		return
 	}
 
-	wgMain := sync.WaitGroup{}
-
-	pickNumChan := make(chan PickInfo)
-	stopChannel := make(chan string)
+	writeJSON(ctx, w, http.StatusOK, summary)
+}
 
-	wgMain.Add(1)
-	go ListenForPickNumbers(pickNumChan, stopChannel, &wgMain)
+// readLeaguePicks is the league worker. It never touches the response or the
+// summary, it only reports back what it found
+func readLeaguePicks(ctx context.Context, snapshot *firestore.DocumentSnapshot) (result leagueResult) {
+	ctx, span := tracing.Start(ctx, "readLeaguePicks", attribute.String("league_id", snapshot.Ref.ID))
+	defer func() {
+		span.SetAttributes(attribute.Bool("skipped", result.Skipped), attribute.Int("picks", len(result.Picks)))
+		tracing.End(span, result.Err)
+	}()
+
+	var league League
+	err := snapshot.DataTo(&league)
+	if err != nil {
+		return leagueResult{LeagueId: snapshot.Ref.ID, Err: fmt.Errorf("error reading league data into object: %v", err)}
+	}
 
-	wg := sync.WaitGroup{}
+	if !league.IsLocked {
+		logging.FromContext(ctx).Debug("league is not locked so we are skipping it", "league_id", league.LeagueId)
+		return leagueResult{LeagueId: league.LeagueId, Skipped: true}
+	}
 
-	ticket := make(chan struct{}, 40)
+	draftSummary, err := utils.Get[DraftSummary](ctx, utils.Db, utils.DraftSummaryPath(league.LeagueId))
+	if err != nil {
+		return leagueResult{LeagueId: league.LeagueId, Err: err}
+	}
 
-	for i := 0; i < len(res); i++ {
-		var league League
-		err = res[i].DataTo(&league)
-		if err != nil {
-			fmt.Println("Error reading league data into object: ", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	picks := make([]PickInfo, 0, len(draftSummary.Summary))
+	for _, pick := range draftSummary.Summary {
+		picks = append(picks, PickInfo{PlayerId: pick.PlayerId, PickNum: pick.PickNum})
+	}
 
-		fmt.Println("League Id: ", league.LeagueId)
-		if !league.IsLocked {
-			fmt.Printf("This league: %s is not locked so we are skipping it\r", league.LeagueId)
-			http.Error(w, fmt.Sprintf("This league: %s is not locked so we are skipping it\r", league.LeagueId), http.StatusInternalServerError)
-			continue
-		}
+	return leagueResult{LeagueId: league.LeagueId, Picks: picks, Cards: len(league.CurrentUsers)}
+}
 
-		ticket <- struct{}{} // would block if guard channel is already filled
-		wg.Add(1)
-		go func() {
-			defer func() {
-				wg.Done()
-				<-ticket
-			}()
-			data, err := utils.Db.Client.Collection(fmt.Sprintf("drafts/%s/state", league.LeagueId)).Doc("summary").Get(context.Background())
-			if err != nil {
-				fmt.Println("Error reading draft summary in adp calculator: ", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+// aggregateLeagueResults is the only reader of the results channel and the
+// only writer of the tracker and the league counts of the summary
+func aggregateLeagueResults(ctx context.Context, results <-chan leagueResult, tracker *DraftPositionTracker, summary *ADPSummary) {
+	for result := range results {
+		switch {
+		case result.Err != nil:
+			logging.FromContext(ctx).Error("error processing league", "league_id", result.LeagueId, "error", result.Err)
+			summary.LeaguesFailed++
+			summary.FailedLeagues = append(summary.FailedLeagues, LeagueFailure{LeagueId: result.LeagueId, Error: result.Err.Error()})
+		case result.Skipped:
+			summary.LeaguesSkipped++
+		default:
+			summary.LeaguesProcessed++
+			summary.CardsDrafted += result.Cards
+			tracker.Cards += result.Cards
+			for _, pick := range result.Picks {
+				tracker.Players[pick.PlayerId] = append(tracker.Players[pick.PlayerId], pick.PickNum)
 			}
+		}
+	}
+}
 
-			var summary DraftSummary
-			err = data.DataTo(&summary)
-			if err != nil {
-				fmt.Println("Error reading data into draft summary: ", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+// ComputeADP reads the draft summary of every locked league and writes the
+// average pick number of each player to playerStats2023/newPlayerMap. With
+// dryRun set the new ADP values are only returned in the summary.
+//
+// Leagues are streamed by a producer to at most WORKER_POOL_SIZE workers and
+// their results are collected by a single aggregator. A league that fails is
+// counted in the summary without stopping the others and ADP is written from
+// the leagues that were read, unless more than ADP_MAX_FAILED_LEAGUES failed.
+// Leagues that failed once ADP is written are only reported in the summary
+func ComputeADP(ctx context.Context, dryRun bool) (summary *ADPSummary, err error) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "ComputeADP", attribute.Bool("dry_run", dryRun))
+	defer func() {
+		metrics.RecordADPRun(summary.LeaguesProcessed, summary.LeaguesSkipped, summary.LeaguesFailed)
+		metrics.ObserveJob("adp", start, err)
+		span.SetAttributes(
+			attribute.Int("leagues.processed", summary.LeaguesProcessed),
+			attribute.Int("leagues.skipped", summary.LeaguesSkipped),
+			attribute.Int("leagues.failed", summary.LeaguesFailed),
+		)
+		tracing.End(span, err)
+	}()
+
+	ctx = logging.WithRun(ctx, "adp")
+	logging.FromContext(ctx).Info("calculating adp", "dry_run", dryRun)
+
+	summary = &ADPSummary{
+		DryRun:        dryRun,
+		FailedLeagues: make([]LeagueFailure, 0),
+		Changes:       make([]ADPChange, 0),
+	}
+	tracker := DraftPositionTracker{
+		Players: make(map[string][]int),
+	}
 
-			for i := 0; i < len(summary.Summary); i++ {
-				pick := summary.Summary[i]
-				pickNumChan <- PickInfo{PlayerId: pick.PlayerId, PickNum: pick.PickNum}
+	if !dryRun {
+		var lock *utils.RunLock
+		ctx, lock, err = utils.Db.AcquireRunLock(ctx, "calculateADP", utils.LockTTLFromEnv(), utils.LockWaitFromEnv())
+		if err != nil {
+			return summary, err
+		}
+		defer func() {
+			releaseErr := lock.Release(ctx)
+			if releaseErr != nil {
+				logging.FromContext(ctx).Warn("error releasing run lock", "error", releaseErr)
 			}
-			fmt.Println("Finihed looping through for ", league.LeagueId)
 		}()
-
 	}
-	fmt.Println("Out of for loop in main function and are waiting for all league processing to finish")
-
-	wg.Wait()
-
-	fmt.Println("done going through leagues and are sending complete signal to go routine to calculate adp")
-	stopChannel <- "complete"
-	fmt.Println("Completed the for loop and am writing to stop channel")
 
-	wgMain.Wait()
+	results := make(chan leagueResult)
+	aggregated := make(chan struct{})
+	go func() {
+		aggregateLeagueResults(ctx, results, &tracker, summary)
+		close(aggregated)
+	}()
+
+	workers, workerCtx := errgroup.WithContext(ctx)
+	workers.SetLimit(utils.WorkersFromEnv())
+
+	streamErr := utils.Db.StreamDocuments(workerCtx, utils.Db.Client.Collection(utils.DraftsCollection).Query, utils.PageSizeFromEnv(), func(snapshot *firestore.DocumentSnapshot) error {
+		// Go blocks until a worker slot is free which holds back the stream
+		workers.Go(func() error {
+			result := readLeaguePicks(workerCtx, snapshot)
+			select {
+			case results <- result:
+				return nil
+			case <-workerCtx.Done():
+				return workerCtx.Err()
+			}
+		})
+		return workerCtx.Err()
+	})
+	workerErr := workers.Wait()
+	close(results)
+	<-aggregated
+
+	switch {
+	case ctx.Err() != nil:
+		return summary, ctx.Err()
+	case streamErr != nil:
+		return summary, fmt.Errorf("error streaming league documents: %v", streamErr)
+	case workerErr != nil:
+		return summary, workerErr
+	}
+	if maxFailed, ok := maxFailedLeaguesFromEnv(); ok && summary.LeaguesFailed > maxFailed {
+		return summary, fmt.Errorf("%d leagues could not be read, more than the %d allowed, so adp was not updated", summary.LeaguesFailed, maxFailed)
+	}
 
-	returnData, err := json.Marshal([]byte("Completed Updated ADP"))
+	logging.FromContext(ctx).Info("read leagues, updating adp", "processed", summary.LeaguesProcessed, "skipped", summary.LeaguesSkipped, "failed", summary.LeaguesFailed)
+	err = updateADP(ctx, tracker, summary)
 	if err != nil {
-		fmt.Println("Error marshalling stats object for return data: ", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return summary, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(returnData)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Println("Error writing data responde: ", err)
-		return
+	if summary.LeaguesFailed > 0 {
+		// retrying would only fail the same leagues again, so they are reported in the summary
+		logging.FromContext(ctx).Warn("adp was updated without the leagues that could not be read", "failed", summary.LeaguesFailed)
 	}
-	fmt.Println("All go routines have finished and adp has been calculated. Everything is done")
-	return
+	return summary, nil
+}
+
+// maxFailedLeaguesFromEnv returns ADP_MAX_FAILED_LEAGUES, the most leagues
+// that may fail to be read for ADP to still be written. Unset means no limit
+func maxFailedLeaguesFromEnv() (int, bool) {
+	value, err := strconv.Atoi(os.Getenv("ADP_MAX_FAILED_LEAGUES"))
+	if err != nil || value < 0 {
+		return 0, false
+	}
+	return value, true
 }
 
 type StatsObject struct {
@@ -168,48 +312,23 @@ type StatsObject struct {
 	ByeWeek         string   `json:"byeWeek"`
 	ADP             float64  `json:"adp"`
 	PlayersFromTeam []string `json:"playersFromTeam"`
+	// share of all drafted cards the player was picked on, from 0 to 1
+	DraftRate float64 `json:"draftRate"`
 }
 
 type StatsMap struct {
 	Players map[string]StatsObject `json:"players"`
 }
 
-func ListenForPickNumbers(pick chan PickInfo, stopChan chan string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	tracker := DraftPositionTracker{
-		Players: make(map[string][]int, 0),
-	}
-
-	fmt.Println("Entering loop to listen for pick nums")
-Loop:
-	for {
-		select {
-		case data := <-pick:
-			fmt.Printf("data recieved: %s, %d", data.PlayerId, data.PickNum)
-			tracker.Players[data.PlayerId] = append(tracker.Players[data.PlayerId], data.PickNum)
-		case mes := <-stopChan:
-			if mes == "complete" {
-				fmt.Println("Recieved complete message")
-				break Loop
-			}
-		}
-	}
-
-	fmt.Println("Out of loop listening for pick nums")
-
-	stats := StatsMap{
-		Players: make(map[string]StatsObject),
-	}
-	data, err := utils.Db.Client.Collection("playerStats2023").Doc("playerMap").Get(context.Background())
+// updateADP averages the tracked picks into the player stats map and records
+// every ADP that moved in the summary. The map is only written outside of a dry run
+func updateADP(ctx context.Context, tracker DraftPositionTracker, summary *ADPSummary) error {
+	stats, err := utils.Get[StatsMap](ctx, utils.Db, utils.PlayerMapPath())
 	if err != nil {
-		fmt.Println("Error reading statsMap: ", err)
-		return
+		return fmt.Errorf("error reading statsMap: %v", err)
 	}
-
-	err = data.DataTo(&stats)
-	if err != nil {
-		fmt.Println("Error reading data into statsMap: ", err)
-		return
+	if stats.Players == nil {
+		stats.Players = make(map[string]StatsObject)
 	}
 
 	newStatsMap := StatsMap{
@@ -224,6 +343,13 @@ Loop:
 
 		avg := float64(sum / len(obj))
 		statsObj := stats.Players[playerId]
+		if statsObj.ADP != avg {
+			summary.Changes = append(summary.Changes, ADPChange{
+				PlayerId:  playerId,
+				ADPBefore: statsObj.ADP,
+				ADPAfter:  avg,
+			})
+		}
 		statsObj.ADP = avg
 		stats.Players[playerId] = statsObj
 
@@ -238,10 +364,17 @@ Loop:
 		// }
 	}
 
+	if tracker.Cards > 0 {
+		for playerId, statsObj := range stats.Players {
+			statsObj.DraftRate = float64(len(tracker.Players[playerId])) / float64(tracker.Cards)
+			stats.Players[playerId] = statsObj
+		}
+	}
+
 	for key, value := range stats.Players {
-		fmt.Printf("key: %s, value: %v\r", key, value)
+		logging.FromContext(ctx).Debug("player stats", "player_id", key, "stats", value)
 		if key == "" {
-			fmt.Println("Found the weird ass thing in the object and skipping it")
+			logging.FromContext(ctx).Debug("skipping player stats entry with an empty player id")
 			continue
 		}
 		newStatsMap.Players[key] = stats.Players[key]
@@ -254,12 +387,16 @@ Loop:
 	// 	},
 	// })
 
-	err = utils.Db.CreateOrUpdateDocument("playerStats2023", "newPlayerMap", newStatsMap)
-	if err != nil {
-		fmt.Println("Error updating playerStats2023/playerMap: ", err)
-		return
+	if summary.DryRun {
+		logging.FromContext(ctx).Info("dry run so playerStats2023/newPlayerMap is not updated", "changes", len(summary.Changes))
+		return nil
 	}
 
-	fmt.Println("Updated ADP")
+	err = utils.Set(ctx, utils.Db, utils.NewPlayerMapPath(), newStatsMap)
+	if err != nil {
+		return fmt.Errorf("error updating playerStats2023/newPlayerMap: %v", err)
+	}
 
+	logging.FromContext(ctx).Info("updated adp", "changes", len(summary.Changes))
+	return nil
 }
@@ -0,0 +1,274 @@
+package cloudfunctions
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"github.com/go-chi/chi"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	cardWidth      = 350
+	cardHeight     = 500
+	cardLineHeight = 18
+	// most rendered card images kept in memory
+	cardImageCacheSize = 2000
+)
+
+// background colour of a card by its level, anything else is drawn in the default
+var levelColors = map[string]color.RGBA{
+	"Pro":          {R: 0x1f, G: 0x3a, B: 0x68, A: 0xff},
+	"Hall of Fame": {R: 0x6b, G: 0x4e, B: 0x16, A: 0xff},
+	"Spoiled":      {R: 0x4a, G: 0x1f, B: 0x5c, A: 0xff},
+}
+
+var defaultCardColor = color.RGBA{R: 0x22, G: 0x22, B: 0x22, A: 0xff}
+
+type cardText struct {
+	X, Y  int
+	Size  int
+	Color color.RGBA
+	Text  string
+}
+
+// cardLayout is what a card image shows, laid out once and then drawn as
+// either an svg or a png so both formats always match
+type cardLayout struct {
+	Background color.RGBA
+	Texts      []cardText
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func layoutCard(token DraftToken) cardLayout {
+	white := color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	muted := color.RGBA{R: 0xbb, G: 0xbb, B: 0xbb, A: 0xff}
+
+	layout := cardLayout{Background: defaultCardColor}
+	if c, ok := levelColors[token.Level]; ok {
+		layout.Background = c
+	}
+
+	y := 40
+	add := func(size int, c color.RGBA, text string) {
+		layout.Texts = append(layout.Texts, cardText{X: 20, Y: y, Size: size, Color: c, Text: text})
+		y += cardLineHeight
+	}
+
+	add(20, white, "Draft Token #"+token.CardId)
+	y += 6
+	if token.LeagueDisplayName != "" {
+		add(13, muted, token.LeagueDisplayName)
+	}
+	if token.Level != "" {
+		add(13, muted, "Level: "+token.Level)
+	}
+	y += 6
+	if token.Rank != "" {
+		add(15, white, "Rank: "+token.Rank)
+	}
+	if token.SeasonScore != "" {
+		add(15, white, "Season: "+token.SeasonScore+" pts")
+	}
+	y += 10
+
+	if token.Roster == nil {
+		add(13, muted, "Not drafted yet")
+		return layout
+	}
+	for _, group := range []struct {
+		position string
+		players  []RosterPlayer
+	}{
+		{"QB", token.Roster.QB},
+		{"RB", token.Roster.RB},
+		{"WR", token.Roster.WR},
+		{"TE", token.Roster.TE},
+		{"DST", token.Roster.DST},
+	} {
+		for _, player := range group.players {
+			if y > cardHeight-cardLineHeight {
+				return layout
+			}
+			add(13, white, fmt.Sprintf("%-4s %s", group.position, player.PlayerId))
+		}
+	}
+	return layout
+}
+
+func renderCardSVG(layout cardLayout) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, cardWidth, cardHeight, cardWidth, cardHeight)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" rx="16" fill="%s"/>`, cardWidth, cardHeight, hexColor(layout.Background))
+	for _, text := range layout.Texts {
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="monospace" font-size="%d" fill="%s" xml:space="preserve">%s</text>`,
+			text.X, text.Y, text.Size, hexColor(text.Color), html.EscapeString(text.Text))
+	}
+	b.WriteString(`</svg>`)
+	return b.Bytes()
+}
+
+// renderCardPNG draws the layout with the fixed size basic font, which keeps
+// the png pure Go at the cost of every line using the same text size
+func renderCardPNG(layout cardLayout) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, cardWidth, cardHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: layout.Background}, image.Point{}, draw.Src)
+
+	for _, text := range layout.Texts {
+		drawer := font.Drawer{
+			Dst:  img,
+			Src:  &image.Uniform{C: text.Color},
+			Face: basicfont.Face7x13,
+			Dot:  fixed.P(text.X, text.Y),
+		}
+		drawer.DrawString(text.Text)
+	}
+
+	var b bytes.Buffer
+	err := png.Encode(&b, img)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// cardVersion changes whenever anything drawn on the card changes, such as a
+// new score or rank, and is used as the cache key and the ETag of the image
+func cardVersion(token DraftToken) string {
+	data, _ := json.Marshal(struct {
+		CardId, Level, League, Rank, SeasonScore string
+		Roster                                   *Roster
+	}{token.CardId, token.Level, token.LeagueDisplayName, token.Rank, token.SeasonScore, token.Roster})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+type cardImage struct {
+	version string
+	data    []byte
+}
+
+type cardImageCache struct {
+	lock   sync.Mutex
+	images map[string]*cardImage
+}
+
+var cardImages = &cardImageCache{images: make(map[string]*cardImage)}
+
+// get returns the image of a card in format at version, rendering it when the
+// cached one is for an older version. Each format is cached on its own so an
+// svg request never pays for rasterizing the png
+func (c *cardImageCache) get(cardId string, format string, version string, render func() ([]byte, error)) ([]byte, error) {
+	key := cardId + "." + format
+	c.lock.Lock()
+	cached, ok := c.images[key]
+	c.lock.Unlock()
+	if ok && cached.version == version {
+		return cached.data, nil
+	}
+
+	data, err := render()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.images) >= cardImageCacheSize {
+		// drop an arbitrary image, images are cheap to render again
+		for id := range c.images {
+			delete(c.images, id)
+			break
+		}
+	}
+	c.images[key] = &cardImage{version: version, data: data}
+	return data, nil
+}
+
+// cardImageUrl is the stable url a card's image is served at, which stays the
+// same as the card changes. Without CARD_IMAGE_BASE_URL the stored ImageUrl is used
+func cardImageUrl(token DraftToken) string {
+	base := strings.TrimRight(os.Getenv("CARD_IMAGE_BASE_URL"), "/")
+	if base == "" {
+		return token.ImageUrl
+	}
+	return fmt.Sprintf("%s/cards/%s/image.svg", base, token.CardId)
+}
+
+func serveCardImage(w http.ResponseWriter, r *http.Request, format string) {
+	ctx := r.Context()
+	cardId := chi.URLParam(r, "cardId")
+
+	token, err := utils.Get[DraftToken](ctx, utils.Db, utils.DraftTokenPath(cardId))
+	if errors.Is(err, utils.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("draft token %s not found", cardId), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("error reading draft token for card image", "card_id", cardId, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if token.CardId == "" {
+		token.CardId = cardId
+	}
+
+	version := cardVersion(token)
+	etag := fmt.Sprintf(`"%s-%s"`, version, format)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, err := cardImages.get(cardId, format, version, func() ([]byte, error) {
+		layout := layoutCard(token)
+		if format == "png" {
+			return renderCardPNG(layout)
+		}
+		return renderCardSVG(layout), nil
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("error rendering card image", "card_id", cardId, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	if format == "png" {
+		w.Header().Set("Content-Type", "image/png")
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		logging.FromContext(ctx).Error("error writing card image", "card_id", cardId, "error", err)
+	}
+}
+
+func CardImageSVGEndPoint(w http.ResponseWriter, r *http.Request) {
+	serveCardImage(w, r, "svg")
+}
+
+func CardImagePNGEndPoint(w http.ResponseWriter, r *http.Request) {
+	serveCardImage(w, r, "png")
+}
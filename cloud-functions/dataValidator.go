@@ -0,0 +1,133 @@
+package cloudfunctions
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+)
+
+type ValidationIssue struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+}
+
+// minimum number of players per position a roster needs before ScoreCards can
+// fill every starting spot and the flex
+var minRosterPositions = map[string]int{
+	"DST": 1,
+	"QB":  1,
+	"RB":  2,
+	"TE":  1,
+	"WR":  2,
+}
+
+func rosterPositionCounts(roster *Roster) map[string]int {
+	return map[string]int{
+		"DST": len(roster.DST),
+		"QB":  len(roster.QB),
+		"RB":  len(roster.RB),
+		"TE":  len(roster.TE),
+		"WR":  len(roster.WR),
+	}
+}
+
+// validateRoster returns the reasons a roster can not be scored
+func validateRoster(roster *Roster) []string {
+	problems := make([]string, 0)
+	counts := rosterPositionCounts(roster)
+	for _, position := range []string{"DST", "QB", "RB", "TE", "WR"} {
+		if counts[position] < minRosterPositions[position] {
+			problems = append(problems, fmt.Sprintf("roster has %d %s but needs at least %d", counts[position], position, minRosterPositions[position]))
+		}
+	}
+	if counts["RB"]-minRosterPositions["RB"]+counts["TE"]-minRosterPositions["TE"]+counts["WR"]-minRosterPositions["WR"] < 1 {
+		problems = append(problems, "roster has no player left for the flex spot")
+	}
+	return problems
+}
+
+func validateLeague(ctx context.Context, league League) []ValidationIssue {
+	path := utils.DraftPath(league.LeagueId).String()
+	summaryPath := utils.DraftSummaryPath(league.LeagueId)
+	issues := make([]ValidationIssue, 0)
+
+	if league.NumPlayers != len(league.CurrentUsers) {
+		issues = append(issues, ValidationIssue{path, fmt.Sprintf("NumPlayers is %d but the league has %d users", league.NumPlayers, len(league.CurrentUsers))})
+	}
+	if league.MaxPlayers > 0 && league.NumPlayers > league.MaxPlayers {
+		issues = append(issues, ValidationIssue{path, fmt.Sprintf("NumPlayers %d is over MaxPlayers %d", league.NumPlayers, league.MaxPlayers)})
+	}
+	if !league.IsLocked {
+		return issues
+	}
+
+	summary, err := utils.Get[DraftSummary](ctx, utils.Db, summaryPath)
+	if err != nil {
+		return append(issues, ValidationIssue{summaryPath.String(), "league is locked but the draft summary could not be read"})
+	}
+
+	pickNums := make(map[int]bool)
+	for _, pick := range summary.Summary {
+		if pick.PlayerId == "" {
+			issues = append(issues, ValidationIssue{summaryPath.String(), fmt.Sprintf("pick %d has no player id", pick.PickNum)})
+		}
+		if pickNums[pick.PickNum] {
+			issues = append(issues, ValidationIssue{summaryPath.String(), fmt.Sprintf("pick number %d is used more than once", pick.PickNum)})
+		}
+		pickNums[pick.PickNum] = true
+	}
+
+	return issues
+}
+
+// ValidateData checks every league and draft token for data that would make
+// the ADP calculator or the scorer skip or fail on it
+func ValidateData(ctx context.Context) ([]ValidationIssue, error) {
+	issues := make([]ValidationIssue, 0)
+
+	err := utils.Db.StreamDocuments(ctx, utils.Db.Client.Collection(utils.DraftsCollection).Query, utils.PageSizeFromEnv(), func(snapshot *firestore.DocumentSnapshot) error {
+		var league League
+		err := snapshot.DataTo(&league)
+		if err != nil {
+			issues = append(issues, ValidationIssue{utils.DraftPath(snapshot.Ref.ID).String(), fmt.Sprintf("could not be read as a league: %v", err)})
+			return nil
+		}
+		issues = append(issues, validateLeague(ctx, league)...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading all league documents: %v", err)
+	}
+
+	err = utils.Db.StreamDocuments(ctx, utils.Db.Client.Collection(utils.DraftTokensCollection).Query, utils.PageSizeFromEnv(), func(snapshot *firestore.DocumentSnapshot) error {
+		path := utils.DraftTokenPath(snapshot.Ref.ID).String()
+		var token DraftToken
+		err := snapshot.DataTo(&token)
+		if err != nil {
+			issues = append(issues, ValidationIssue{path, fmt.Sprintf("could not be read as a draft token: %v", err)})
+			return nil
+		}
+		if token.LeagueId == "" {
+			issues = append(issues, ValidationIssue{path, "token has no league id"})
+		}
+		if token.Roster == nil {
+			issues = append(issues, ValidationIssue{path, "token has no roster"})
+			return nil
+		}
+		if len(token.Roster.DST) == 0 {
+			// the scorer skips these tokens on purpose until the draft has finished
+			return nil
+		}
+		for _, problem := range validateRoster(token.Roster) {
+			issues = append(issues, ValidationIssue{path, problem})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading all draft tokens: %v", err)
+	}
+
+	return issues, nil
+}
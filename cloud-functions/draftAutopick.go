@@ -0,0 +1,256 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const defaultPickTime = 60 * time.Second
+
+var errPickNotExpired = errors.New("pick timer has not run out")
+
+// PickTimeFromEnv returns DRAFT_PICK_TIME, the time an owner has for every pick
+func PickTimeFromEnv() time.Duration {
+	if value, err := time.ParseDuration(os.Getenv("DRAFT_PICK_TIME")); err == nil && value >= time.Second {
+		return value
+	}
+	return defaultPickTime
+}
+
+// DraftQueue is the ranked list of players an owner wants autopicked for them,
+// kept at drafts/{id}/queues/{ownerAddress}
+type DraftQueue struct {
+	OwnerAddress string   `json:"ownerAddress"`
+	PlayerIds    []string `json:"playerIds"`
+}
+
+// chooseAutopick returns the first player of the owner's queue that is a
+// valid pick, or otherwise the valid player with the best ADP. Players that
+// have never been drafted have no ADP and go last
+func chooseAutopick(state *DraftState, summary DraftSummary, owner string, queue DraftQueue, pool map[string]StatsObject) (string, error) {
+	for _, playerId := range queue.PlayerIds {
+		if validatePick(state, summary, owner, playerId, pool) == nil {
+			return playerId, nil
+		}
+	}
+
+	ranked := make([]StatsObject, 0, len(pool))
+	for playerId, player := range pool {
+		player.PlayerId = playerId
+		ranked = append(ranked, player)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i].ADP, ranked[j].ADP
+		if (a == 0) != (b == 0) {
+			return b == 0
+		}
+		if a != b {
+			return a < b
+		}
+		return ranked[i].PlayerId < ranked[j].PlayerId
+	})
+	for _, player := range ranked {
+		if validatePick(state, summary, owner, player.PlayerId, pool) == nil {
+			return player.PlayerId, nil
+		}
+	}
+	return "", fmt.Errorf("no valid player left to autopick for %s", owner)
+}
+
+// AutopickExpiredPick makes the current pick of a draft for the owner on the
+// clock once its deadline has passed
+func AutopickExpiredPick(ctx context.Context, leagueId string) (pick PlayerInfo, state DraftState, err error) {
+	ctx, span := tracing.Start(ctx, "AutopickExpiredPick", attribute.String("league_id", leagueId))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	pool, err := loadPlayerPool(ctx)
+	if err != nil {
+		return pick, state, err
+	}
+
+	err = utils.Db.RunTransaction(ctx, utils.DraftsCollection, func(ctx context.Context, tx *firestore.Transaction) error {
+		state, err = utils.TxGet[DraftState](tx, utils.Db, utils.DraftInfoPath(leagueId))
+		if err != nil {
+			return err
+		}
+		summary, err := utils.TxGet[DraftSummary](tx, utils.Db, utils.DraftSummaryPath(leagueId))
+		if err != nil {
+			return err
+		}
+		if state.Status == DraftStatusComplete {
+			return errDraftComplete
+		}
+		if time.Now().Before(state.PickDeadline) {
+			return fmt.Errorf("%w: pick %d is due at %s", errPickNotExpired, state.CurrentPickNum, state.PickDeadline.Format(time.RFC3339))
+		}
+
+		owner, _ := state.OnTheClock(state.CurrentPickNum)
+		queue, err := utils.TxGet[DraftQueue](tx, utils.Db, utils.DraftQueuePath(leagueId, owner))
+		if err != nil && !errors.Is(err, utils.ErrNotFound) {
+			return err
+		}
+		playerId, err := chooseAutopick(&state, summary, owner, queue, pool)
+		if err != nil {
+			return err
+		}
+		pick, err = recordPick(tx, &state, &summary, playerId, pool)
+		return err
+	})
+	if err != nil {
+		return pick, state, err
+	}
+
+	logging.FromContext(ctx).Info("autopicked expired pick", "league_id", leagueId, "pick_num", pick.PickNum, "player_id", pick.PlayerId, "owner", pick.OwnerAddress)
+	afterPick(ctx, pick, state)
+	return pick, state, nil
+}
+
+// timers holds one timer per active draft on this instance that autopicks
+// when the current pick runs out. Timers are lost on restart, which the
+// autopick job covers by sweeping every draft with an expired deadline
+type timers struct {
+	lock   sync.Mutex
+	timers map[string]*time.Timer
+}
+
+var pickTimers = &timers{timers: make(map[string]*time.Timer)}
+
+func (t *timers) schedule(state DraftState) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if timer, ok := t.timers[state.LeagueId]; ok {
+		timer.Stop()
+	}
+	leagueId := state.LeagueId
+	t.timers[leagueId] = time.AfterFunc(time.Until(state.PickDeadline), func() {
+		ctx, cancel := utils.JobContext(context.Background())
+		defer cancel()
+		ctx = logging.WithRun(ctx, "autopick")
+
+		_, current, err := AutopickExpiredPick(ctx, leagueId)
+		switch {
+		case errors.Is(err, errPickNotExpired):
+			// someone picked in time, or the deadline moved, so wait for the new one
+			t.schedule(current)
+		case errors.Is(err, errDraftComplete):
+			t.stop(leagueId)
+		case err != nil:
+			logging.FromContext(ctx).Error("error autopicking expired pick", "league_id", leagueId, "error", err)
+		}
+	})
+}
+
+func (t *timers) stop(leagueId string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if timer, ok := t.timers[leagueId]; ok {
+		timer.Stop()
+		delete(t.timers, leagueId)
+	}
+}
+
+type AutopickSummary struct {
+	DraftsChecked int      `json:"draftsChecked"`
+	Autopicked    int      `json:"autopicked"`
+	Failed        []string `json:"failed"`
+}
+
+// AutopickExpiredDrafts autopicks the current pick of every draft whose pick
+// timer ran out, for deadlines no instance had a timer for
+func AutopickExpiredDrafts(ctx context.Context) (summary *AutopickSummary, err error) {
+	ctx, span := tracing.Start(ctx, "AutopickExpiredDrafts")
+	defer func() {
+		tracing.End(span, err)
+	}()
+	ctx = logging.WithRun(ctx, "autopick")
+
+	summary = &AutopickSummary{Failed: make([]string, 0)}
+	query := utils.Db.Client.CollectionGroup("state").Where("Status", "==", DraftStatusDrafting)
+	states, err := utils.Query[DraftState](ctx, utils.Db, query)
+	if err != nil {
+		return summary, fmt.Errorf("error reading drafts in progress: %v", err)
+	}
+
+	now := time.Now()
+	for _, state := range states {
+		summary.DraftsChecked++
+		if now.Before(state.PickDeadline) {
+			continue
+		}
+		_, _, err := AutopickExpiredPick(ctx, state.LeagueId)
+		if errors.Is(err, errPickNotExpired) || errors.Is(err, errDraftComplete) {
+			continue
+		}
+		if err != nil {
+			logging.FromContext(ctx).Error("error autopicking expired pick", "league_id", state.LeagueId, "error", err)
+			summary.Failed = append(summary.Failed, state.LeagueId)
+			continue
+		}
+		summary.Autopicked++
+	}
+
+	logging.FromContext(ctx).Info("finished autopicking expired picks", "checked", summary.DraftsChecked, "autopicked", summary.Autopicked, "failed", len(summary.Failed))
+	return summary, nil
+}
+
+// SetDraftQueue replaces the ranked autopick queue of an owner in a draft
+func SetDraftQueue(ctx context.Context, leagueId string, queue DraftQueue) error {
+	state, err := utils.Get[DraftState](ctx, utils.Db, utils.DraftInfoPath(leagueId))
+	if err != nil {
+		return err
+	}
+	inDraft := false
+	for _, owner := range state.DraftOrder {
+		inDraft = inDraft || owner == queue.OwnerAddress
+	}
+	if !inDraft {
+		return fmt.Errorf("%w: %s is not in draft %s", errNotInDraft, queue.OwnerAddress, leagueId)
+	}
+	return utils.Set(ctx, utils.Db, utils.DraftQueuePath(leagueId, queue.OwnerAddress), queue)
+}
+
+func SetDraftQueueEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var queue DraftQueue
+	err := json.NewDecoder(r.Body).Decode(&queue)
+	if err != nil {
+		http.Error(w, fmt.Sprint("Error decoding draft queue body: ", err), http.StatusBadRequest)
+		return
+	}
+	queue.OwnerAddress = chi.URLParam(r, "ownerAddress")
+
+	err = SetDraftQueue(ctx, chi.URLParam(r, "leagueId"), queue)
+	if err != nil {
+		writeDraftError(ctx, w, err)
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, queue)
+}
+
+func GetDraftQueueEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	queue, err := utils.Get[DraftQueue](ctx, utils.Db, utils.DraftQueuePath(chi.URLParam(r, "leagueId"), chi.URLParam(r, "ownerAddress")))
+	if err != nil {
+		writeDraftError(ctx, w, err)
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, queue)
+}
@@ -0,0 +1,77 @@
+package cloudfunctions
+
+import "testing"
+
+func TestChooseAutopick(t *testing.T) {
+	pool := func(adp map[string]float64) map[string]StatsObject {
+		players := make(map[string]StatsObject, len(adp))
+		for id, value := range adp {
+			players[id] = StatsObject{PlayerId: id, ADP: value}
+		}
+		return players
+	}
+	// a already holds the most DSTs a roster can and b has taken BUF-QB
+	summary := DraftSummary{Summary: []PlayerInfo{
+		{PlayerId: "BUF-DST", Position: "DST", OwnerAddress: "a", PickNum: 1},
+		{PlayerId: "BUF-QB", Position: "QB", OwnerAddress: "b", PickNum: 2},
+		{PlayerId: "NYJ-DST", Position: "DST", OwnerAddress: "a", PickNum: 4},
+	}}
+
+	tests := []struct {
+		name  string
+		queue []string
+		pool  map[string]StatsObject
+		want  string
+	}{
+		{
+			name:  "skips invalid queue entries",
+			queue: []string{"KC-QB", "BUF-QB", "MIA-DST", "MIA-WR"},
+			pool:  pool(map[string]float64{"BUF-QB": 1, "MIA-DST": 2, "MIA-WR": 50, "ATL-WR": 3}),
+			want:  "MIA-WR",
+		},
+		{
+			name:  "falls back to adp when the queue has no valid player",
+			queue: []string{"BUF-QB", "MIA-DST"},
+			pool:  pool(map[string]float64{"BUF-QB": 1, "MIA-DST": 2, "MIA-WR": 50, "ATL-WR": 3}),
+			want:  "ATL-WR",
+		},
+		{
+			name: "players without adp rank last",
+			pool: pool(map[string]float64{"ATL-RB": 0, "MIA-RB": 30}),
+			want: "MIA-RB",
+		},
+		{
+			name: "only players without adp left",
+			pool: pool(map[string]float64{"MIA-RB": 0, "ATL-RB": 0}),
+			want: "ATL-RB",
+		},
+		{
+			name: "ties broken by id",
+			pool: pool(map[string]float64{"MIA-WR": 10, "ATL-WR": 10, "NYJ-WR": 12}),
+			want: "ATL-WR",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &DraftState{DraftOrder: []string{"a", "b"}, Rounds: draftRounds, CurrentPickNum: 5}
+			got, err := chooseAutopick(state, summary, "a", DraftQueue{OwnerAddress: "a", PlayerIds: tt.queue}, tt.pool)
+			if err != nil {
+				t.Fatalf("chooseAutopick() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("chooseAutopick() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChooseAutopickNoValidPlayer(t *testing.T) {
+	state := &DraftState{DraftOrder: []string{"a", "b"}, Rounds: draftRounds}
+	summary := DraftSummary{Summary: []PlayerInfo{{PlayerId: "BUF-QB", Position: "QB", OwnerAddress: "b", PickNum: 1}}}
+	pool := map[string]StatsObject{"BUF-QB": {PlayerId: "BUF-QB", ADP: 1}}
+
+	_, err := chooseAutopick(state, summary, "a", DraftQueue{}, pool)
+	if err == nil {
+		t.Error("chooseAutopick() error = nil, want an error when every player is taken")
+	}
+}
@@ -0,0 +1,424 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	DraftStatusDrafting = "drafting"
+	DraftStatusComplete = "complete"
+)
+
+// number of picks every owner makes in a draft
+const draftRounds = 15
+
+// most players of a position one roster may draft
+var maxRosterPositions = map[string]int{
+	"DST": 2,
+	"QB":  3,
+	"RB":  5,
+	"TE":  3,
+	"WR":  6,
+}
+
+var (
+	errDraftExists   = errors.New("draft already exists")
+	errDraftNotReady = errors.New("league is not ready to draft")
+	errDraftComplete = errors.New("draft is complete")
+	errNotOnClock    = errors.New("owner is not on the clock")
+	errNotInDraft    = errors.New("owner is not in the draft")
+	errUnknownPlayer = errors.New("unknown player")
+	errPlayerTaken   = errors.New("player has already been drafted")
+	errPositionFull  = errors.New("roster is full at that position")
+	errRosterNeeds   = errors.New("pick leaves too few picks for the roster's open starting spots")
+)
+
+// DraftState is kept at drafts/{id}/state/info next to the summary and holds
+// what the summary alone can not tell, such as whose turn it is
+type DraftState struct {
+	LeagueId string `json:"leagueId"`
+	// owner addresses in the order they pick in the first round
+	DraftOrder []string `json:"draftOrder"`
+	Rounds     int      `json:"rounds"`
+	// number of the next pick, starting at 1
+	CurrentPickNum int    `json:"currentPickNum"`
+	Status         string `json:"status"`
+	// seconds an owner has to make a pick before it is made for them
+	PickTimeSeconds int `json:"pickTimeSeconds"`
+	// when the current pick gets autopicked, zero once the draft is complete
+	PickDeadline time.Time `json:"pickDeadline"`
+	StartedAt    time.Time `json:"startedAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// TotalPicks is the number of picks made over the whole draft
+func (s *DraftState) TotalPicks() int {
+	return s.Rounds * len(s.DraftOrder)
+}
+
+// OnTheClock returns the owner making the given pick and the round it is in.
+// Rounds snake, so the owner picking last in one round picks first in the next
+func (s *DraftState) OnTheClock(pickNum int) (owner string, round int) {
+	teams := len(s.DraftOrder)
+	round = (pickNum-1)/teams + 1
+	slot := (pickNum - 1) % teams
+	if round%2 == 0 {
+		slot = teams - 1 - slot
+	}
+	return s.DraftOrder[slot], round
+}
+
+// splitPlayerId splits a player id such as BUF-RB2 into its team and roster
+// position, dropping the number that tells apart players of the same position
+func splitPlayerId(playerId string) (team string, position string) {
+	parts := strings.Split(playerId, "-")
+	if len(parts) < 2 {
+		return "", ""
+	}
+	team = strings.Join(parts[:len(parts)-1], "-")
+	position = strings.TrimRight(parts[len(parts)-1], "0123456789")
+	return team, position
+}
+
+// loadPlayerPool returns every draftable player from the stats map the ADP
+// calculator writes, falling back to the one it reads
+func loadPlayerPool(ctx context.Context) (map[string]StatsObject, error) {
+	stats, err := utils.Get[StatsMap](ctx, utils.Db, utils.NewPlayerMapPath())
+	if errors.Is(err, utils.ErrNotFound) {
+		stats, err = utils.Get[StatsMap](ctx, utils.Db, utils.PlayerMapPath())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading player stats map: %v", err)
+	}
+	pool := make(map[string]StatsObject, len(stats.Players))
+	for playerId, player := range stats.Players {
+		if _, position := splitPlayerId(playerId); maxRosterPositions[position] == 0 {
+			continue
+		}
+		pool[playerId] = player
+	}
+	return pool, nil
+}
+
+// openRosterNeeds is the number of picks an owner still has to spend filling
+// the starting spots and the flex given how many of each position they have
+func openRosterNeeds(counts map[string]int) int {
+	needs := 0
+	flexDepth := 0
+	for position, min := range minRosterPositions {
+		if counts[position] < min {
+			needs += min - counts[position]
+		} else if position == "RB" || position == "TE" || position == "WR" {
+			flexDepth += counts[position] - min
+		}
+	}
+	if flexDepth < 1 {
+		needs++
+	}
+	return needs
+}
+
+// ownerPositionCounts counts the positions an owner has drafted so far
+func ownerPositionCounts(summary DraftSummary, owner string) (counts map[string]int, picks int) {
+	counts = make(map[string]int)
+	for _, pick := range summary.Summary {
+		if pick.OwnerAddress == owner {
+			counts[pick.Position]++
+			picks++
+		}
+	}
+	return counts, picks
+}
+
+// checkTurn checks that the draft is still running and owner is on the clock
+func checkTurn(state *DraftState, owner string) error {
+	if state.Status == DraftStatusComplete {
+		return errDraftComplete
+	}
+	onTheClock, _ := state.OnTheClock(state.CurrentPickNum)
+	if onTheClock != owner {
+		return fmt.Errorf("%w: pick %d belongs to %s", errNotOnClock, state.CurrentPickNum, onTheClock)
+	}
+	return nil
+}
+
+// validatePick checks a pick against the players taken so far and the roster
+// limits of the owner making it
+func validatePick(state *DraftState, summary DraftSummary, owner string, playerId string, pool map[string]StatsObject) error {
+	if _, ok := pool[playerId]; !ok {
+		return fmt.Errorf("%w: %s", errUnknownPlayer, playerId)
+	}
+	for _, pick := range summary.Summary {
+		if pick.PlayerId == playerId {
+			return fmt.Errorf("%w: %s went at pick %d", errPlayerTaken, playerId, pick.PickNum)
+		}
+	}
+
+	_, position := splitPlayerId(playerId)
+	counts, picks := ownerPositionCounts(summary, owner)
+	if counts[position] >= maxRosterPositions[position] {
+		return fmt.Errorf("%w: already has %d %s", errPositionFull, counts[position], position)
+	}
+
+	counts[position]++
+	remaining := state.Rounds - picks - 1
+	if needs := openRosterNeeds(counts); needs > remaining {
+		return fmt.Errorf("%w: %d picks left for %d open spots", errRosterNeeds, remaining, needs)
+	}
+	return nil
+}
+
+// CreateDraft starts the draft of a locked league, with owners picking in the
+// order they joined the league
+func CreateDraft(ctx context.Context, leagueId string) (state DraftState, err error) {
+	ctx, span := tracing.Start(ctx, "CreateDraft", attribute.String("league_id", leagueId))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	err = utils.Db.RunTransaction(ctx, utils.DraftsCollection, func(ctx context.Context, tx *firestore.Transaction) error {
+		league, err := utils.TxGet[League](tx, utils.Db, utils.DraftPath(leagueId))
+		if err != nil {
+			return err
+		}
+		if !league.IsLocked || len(league.CurrentUsers) < 2 {
+			return fmt.Errorf("%w: league %s is not locked or has fewer than 2 users", errDraftNotReady, leagueId)
+		}
+
+		_, err = utils.TxGet[DraftState](tx, utils.Db, utils.DraftInfoPath(leagueId))
+		if err == nil {
+			return fmt.Errorf("%w: %s", errDraftExists, leagueId)
+		}
+		if !errors.Is(err, utils.ErrNotFound) {
+			return err
+		}
+
+		now := time.Now()
+		pickTime := PickTimeFromEnv()
+		state = DraftState{
+			LeagueId:        leagueId,
+			DraftOrder:      make([]string, 0, len(league.CurrentUsers)),
+			Rounds:          draftRounds,
+			CurrentPickNum:  1,
+			Status:          DraftStatusDrafting,
+			PickTimeSeconds: int(pickTime / time.Second),
+			PickDeadline:    now.Add(pickTime),
+			StartedAt:       now,
+			UpdatedAt:       now,
+		}
+		for _, user := range league.CurrentUsers {
+			state.DraftOrder = append(state.DraftOrder, user.OwnerId)
+		}
+
+		err = utils.TxSet(tx, utils.Db, utils.DraftInfoPath(leagueId), state)
+		if err != nil {
+			return err
+		}
+		return utils.TxSet(tx, utils.Db, utils.DraftSummaryPath(leagueId), DraftSummary{Summary: make([]PlayerInfo, 0)})
+	})
+	if err != nil {
+		return state, err
+	}
+
+	logging.FromContext(ctx).Info("created draft", "league_id", leagueId, "owners", len(state.DraftOrder))
+	pickTimers.schedule(state)
+	publishDraftEvent(ctx, leagueId, DraftEventOnTheClock, onTheClockEvent(state))
+	return state, nil
+}
+
+// MakePick records the pick of the owner on the clock and moves the draft on
+// to the next pick, completing it after the last round
+func MakePick(ctx context.Context, leagueId string, owner string, playerId string) (pick PlayerInfo, state DraftState, err error) {
+	ctx, span := tracing.Start(ctx, "MakePick", attribute.String("league_id", leagueId), attribute.String("player_id", playerId))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	pool, err := loadPlayerPool(ctx)
+	if err != nil {
+		return pick, state, err
+	}
+
+	err = utils.Db.RunTransaction(ctx, utils.DraftsCollection, func(ctx context.Context, tx *firestore.Transaction) error {
+		state, err = utils.TxGet[DraftState](tx, utils.Db, utils.DraftInfoPath(leagueId))
+		if err != nil {
+			return err
+		}
+		summary, err := utils.TxGet[DraftSummary](tx, utils.Db, utils.DraftSummaryPath(leagueId))
+		if err != nil {
+			return err
+		}
+		err = checkTurn(&state, owner)
+		if err != nil {
+			return err
+		}
+		pick, err = recordPick(tx, &state, &summary, playerId, pool)
+		return err
+	})
+	if err != nil {
+		return pick, state, err
+	}
+
+	logging.FromContext(ctx).Info("recorded pick", "league_id", leagueId, "pick_num", pick.PickNum, "player_id", playerId, "owner", owner)
+	afterPick(ctx, pick, state)
+	return pick, state, nil
+}
+
+// recordPick validates the pick of the owner on the clock, adds it to the
+// summary and moves the state on to the next pick, writing both in tx
+func recordPick(tx *firestore.Transaction, state *DraftState, summary *DraftSummary, playerId string, pool map[string]StatsObject) (PlayerInfo, error) {
+	owner, round := state.OnTheClock(state.CurrentPickNum)
+	err := validatePick(state, *summary, owner, playerId, pool)
+	if err != nil {
+		return PlayerInfo{}, err
+	}
+
+	team, position := splitPlayerId(playerId)
+	pick := PlayerInfo{
+		PlayerId:     playerId,
+		DisplayName:  team + " " + position,
+		Team:         team,
+		Position:     position,
+		OwnerAddress: owner,
+		PickNum:      state.CurrentPickNum,
+		Round:        round,
+	}
+	summary.Summary = append(summary.Summary, pick)
+
+	now := time.Now()
+	state.CurrentPickNum++
+	state.UpdatedAt = now
+	state.PickDeadline = now.Add(time.Duration(state.PickTimeSeconds) * time.Second)
+	if state.CurrentPickNum > state.TotalPicks() {
+		state.Status = DraftStatusComplete
+		state.PickDeadline = time.Time{}
+	}
+
+	err = utils.TxSet(tx, utils.Db, utils.DraftSummaryPath(state.LeagueId), *summary)
+	if err != nil {
+		return pick, err
+	}
+	return pick, utils.TxSet(tx, utils.Db, utils.DraftInfoPath(state.LeagueId), *state)
+}
+
+// afterPick runs once a pick is committed. It tells the draft room about the
+// pick and restarts the pick timer, or stops it when the draft is complete
+func afterPick(ctx context.Context, pick PlayerInfo, state DraftState) {
+	publishDraftEvent(ctx, state.LeagueId, DraftEventPick, pick)
+	if state.Status == DraftStatusComplete {
+		logging.FromContext(ctx).Info("draft complete", "league_id", state.LeagueId)
+		pickTimers.stop(state.LeagueId)
+		publishDraftEvent(ctx, state.LeagueId, DraftEventComplete, state)
+		// clients still connected get draft_complete before the topic goes away
+		DraftEvents.Retire(state.LeagueId)
+		finalizeInBackground(ctx, state.LeagueId)
+		return
+	}
+	pickTimers.schedule(state)
+	publishDraftEvent(ctx, state.LeagueId, DraftEventOnTheClock, onTheClockEvent(state))
+}
+
+type DraftView struct {
+	State   DraftState   `json:"state"`
+	Summary DraftSummary `json:"summary"`
+	// owner making the next pick, empty once the draft is complete
+	OnTheClock string `json:"onTheClock,omitempty"`
+}
+
+// GetDraft reads the state and summary of a draft
+func GetDraft(ctx context.Context, leagueId string) (DraftView, error) {
+	var view DraftView
+	state, err := utils.Get[DraftState](ctx, utils.Db, utils.DraftInfoPath(leagueId))
+	if err != nil {
+		return view, err
+	}
+	summary, err := utils.Get[DraftSummary](ctx, utils.Db, utils.DraftSummaryPath(leagueId))
+	if err != nil {
+		return view, err
+	}
+
+	view = DraftView{State: state, Summary: summary}
+	if state.Status != DraftStatusComplete {
+		view.OnTheClock, _ = state.OnTheClock(state.CurrentPickNum)
+	}
+	return view, nil
+}
+
+type MakePickRequest struct {
+	OwnerAddress string `json:"ownerAddress"`
+	PlayerId     string `json:"playerId"`
+}
+
+// draftErrorStatus maps a draft engine error to the response status
+func draftErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errUnknownPlayer), errors.Is(err, errNotInDraft):
+		return http.StatusBadRequest
+	case errors.Is(err, errDraftExists), errors.Is(err, errDraftNotReady), errors.Is(err, errDraftComplete), errors.Is(err, errPickNotExpired), errors.Is(err, errDraftNotComplete),
+		errors.Is(err, errNotOnClock), errors.Is(err, errPlayerTaken), errors.Is(err, errPositionFull), errors.Is(err, errRosterNeeds):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func writeDraftError(ctx context.Context, w http.ResponseWriter, err error) {
+	status := draftErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		logging.FromContext(ctx).Error("draft request failed", "error", err)
+	} else {
+		logging.FromContext(ctx).Info("draft request rejected", "error", err)
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func CreateDraftEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	state, err := CreateDraft(ctx, chi.URLParam(r, "leagueId"))
+	if err != nil {
+		writeDraftError(ctx, w, err)
+		return
+	}
+	writeJSON(ctx, w, http.StatusCreated, state)
+}
+
+func GetDraftEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	view, err := GetDraft(ctx, chi.URLParam(r, "leagueId"))
+	if err != nil {
+		writeDraftError(ctx, w, err)
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, view)
+}
+
+func MakePickEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var reqData MakePickRequest
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		http.Error(w, fmt.Sprint("Error decoding pick request body: ", err), http.StatusBadRequest)
+		return
+	}
+
+	pick, state, err := MakePick(ctx, chi.URLParam(r, "leagueId"), reqData.OwnerAddress, reqData.PlayerId)
+	if err != nil {
+		writeDraftError(ctx, w, err)
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, map[string]any{"pick": pick, "state": state})
+}
@@ -0,0 +1,94 @@
+package cloudfunctions
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOnTheClock(t *testing.T) {
+	state := &DraftState{DraftOrder: []string{"a", "b", "c"}, Rounds: draftRounds}
+
+	tests := []struct {
+		pickNum int
+		owner   string
+		round   int
+	}{
+		{1, "a", 1},
+		{3, "c", 1},
+		// the owner picking last in a round picks first in the next
+		{4, "c", 2},
+		{6, "a", 2},
+		{7, "a", 3},
+		{9, "c", 3},
+		{10, "c", 4},
+		{state.TotalPicks(), "c", draftRounds},
+	}
+	for _, tt := range tests {
+		owner, round := state.OnTheClock(tt.pickNum)
+		if owner != tt.owner || round != tt.round {
+			t.Errorf("OnTheClock(%d) = %s, round %d, want %s, round %d", tt.pickNum, owner, round, tt.owner, tt.round)
+		}
+	}
+}
+
+func TestCheckTurn(t *testing.T) {
+	tests := []struct {
+		name  string
+		state DraftState
+		owner string
+		want  error
+	}{
+		// pick 3 opens the reversed second round
+		{"on the clock", DraftState{DraftOrder: []string{"a", "b"}, CurrentPickNum: 3, Status: DraftStatusDrafting}, "b", nil},
+		{"out of turn", DraftState{DraftOrder: []string{"a", "b"}, CurrentPickNum: 3, Status: DraftStatusDrafting}, "a", errNotOnClock},
+		{"draft complete", DraftState{DraftOrder: []string{"a", "b"}, CurrentPickNum: 3, Status: DraftStatusComplete}, "b", errDraftComplete},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTurn(&tt.state, tt.owner)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("checkTurn() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePick(t *testing.T) {
+	pool := map[string]StatsObject{}
+	for _, id := range []string{"BUF-QB", "MIA-QB", "BUF-DST", "MIA-DST", "NYJ-DST", "BUF-RB", "BUF-WR"} {
+		pool[id] = StatsObject{PlayerId: id}
+	}
+	picks := func(owner string, playerIds ...string) DraftSummary {
+		summary := DraftSummary{}
+		for i, id := range playerIds {
+			_, position := splitPlayerId(id)
+			summary.Summary = append(summary.Summary, PlayerInfo{PlayerId: id, Position: position, OwnerAddress: owner, PickNum: i + 1})
+		}
+		return summary
+	}
+
+	tests := []struct {
+		name     string
+		rounds   int
+		summary  DraftSummary
+		playerId string
+		want     error
+	}{
+		{"valid pick", draftRounds, DraftSummary{}, "BUF-QB", nil},
+		{"unknown player", draftRounds, DraftSummary{}, "KC-QB", errUnknownPlayer},
+		{"player taken", draftRounds, picks("b", "BUF-QB"), "BUF-QB", errPlayerTaken},
+		{"position full", draftRounds, picks("a", "BUF-DST", "MIA-DST"), "NYJ-DST", errPositionFull},
+		// eight rounds is exactly the starters and the flex
+		{"fills a starting spot", 8, DraftSummary{}, "BUF-QB", nil},
+		{"leaves starters unfilled", 8, picks("a", "BUF-QB"), "MIA-QB", errRosterNeeds},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &DraftState{DraftOrder: []string{"a", "b"}, Rounds: tt.rounds}
+			err := validatePick(state, tt.summary, "a", tt.playerId, pool)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("validatePick(%s) = %v, want %v", tt.playerId, err, tt.want)
+			}
+		})
+	}
+}
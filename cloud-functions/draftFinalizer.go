@@ -0,0 +1,219 @@
+package cloudfunctions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var errDraftNotComplete = errors.New("draft is not complete")
+
+// FirstGameweekFromEnv returns FIRST_GAMEWEEK, the gameweek a finished draft
+// gets its first card scores for
+func FirstGameweekFromEnv() string {
+	if value := os.Getenv("FIRST_GAMEWEEK"); value != "" {
+		return value
+	}
+	return "1"
+}
+
+type FinalizeSummary struct {
+	LeagueId          string   `json:"leagueId"`
+	GameWeek          string   `json:"gameWeek"`
+	CardsFinalized    int      `json:"cardsFinalized"`
+	CardScoresCreated int      `json:"cardScoresCreated"`
+	CardScoresKept    int      `json:"cardScoresKept"`
+	OwnersWithoutPick []string `json:"ownersWithoutPick"`
+}
+
+// scorePosition is the position a player has in CardScores, where the first
+// RB and WR of a team are RB1 and WR1 rather than RB and WR
+func scorePosition(playerId string) string {
+	parts := strings.Split(playerId, "-")
+	position := parts[len(parts)-1]
+	if position == "RB" || position == "WR" {
+		return position + "1"
+	}
+	return position
+}
+
+// buildRosters groups the picks of a draft summary into a Roster per owner
+func buildRosters(summary DraftSummary) map[string]*Roster {
+	rosters := make(map[string]*Roster)
+	for _, pick := range summary.Summary {
+		roster, ok := rosters[pick.OwnerAddress]
+		if !ok {
+			roster = &Roster{
+				DST: make([]RosterPlayer, 0),
+				QB:  make([]RosterPlayer, 0),
+				RB:  make([]RosterPlayer, 0),
+				TE:  make([]RosterPlayer, 0),
+				WR:  make([]RosterPlayer, 0),
+			}
+			rosters[pick.OwnerAddress] = roster
+		}
+
+		player := RosterPlayer{Team: pick.Team, PlayerId: pick.PlayerId, DisplayName: pick.DisplayName}
+		switch pick.Position {
+		case "DST":
+			roster.DST = append(roster.DST, player)
+		case "QB":
+			roster.QB = append(roster.QB, player)
+		case "RB":
+			roster.RB = append(roster.RB, player)
+		case "TE":
+			roster.TE = append(roster.TE, player)
+		case "WR":
+			roster.WR = append(roster.WR, player)
+		}
+	}
+	return rosters
+}
+
+// newCardScores is the empty CardScores of a card before any week is scored
+func newCardScores(cardId string, roster *Roster) CardScores {
+	toScoreObjects := func(players []RosterPlayer) []ScoreObject {
+		objects := make([]ScoreObject, 0, len(players))
+		for _, player := range players {
+			objects = append(objects, ScoreObject{
+				PlayerId: player.PlayerId,
+				Team:     player.Team,
+				Position: scorePosition(player.PlayerId),
+			})
+		}
+		return objects
+	}
+
+	return CardScores{
+		CardId: cardId,
+		Roster: ScoreRoster{
+			DST: toScoreObjects(roster.DST),
+			QB:  toScoreObjects(roster.QB),
+			RB:  toScoreObjects(roster.RB),
+			TE:  toScoreObjects(roster.TE),
+			WR:  toScoreObjects(roster.WR),
+		},
+	}
+}
+
+// FinalizeDraft writes the roster each owner drafted to their draft token and
+// creates the card scores of the gameweek for it. Card scores that already
+// exist are kept so finalizing again never wipes out a scored week
+func FinalizeDraft(ctx context.Context, leagueId string, gameweek string) (summary *FinalizeSummary, err error) {
+	ctx, span := tracing.Start(ctx, "FinalizeDraft", attribute.String("league_id", leagueId), attribute.String("gameweek", gameweek))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	summary = &FinalizeSummary{LeagueId: leagueId, GameWeek: gameweek, OwnersWithoutPick: make([]string, 0)}
+
+	state, err := utils.Get[DraftState](ctx, utils.Db, utils.DraftInfoPath(leagueId))
+	if err != nil {
+		return summary, err
+	}
+	if state.Status != DraftStatusComplete {
+		return summary, fmt.Errorf("%w: %s is at pick %d", errDraftNotComplete, leagueId, state.CurrentPickNum)
+	}
+	league, err := utils.Get[League](ctx, utils.Db, utils.DraftPath(leagueId))
+	if err != nil {
+		return summary, err
+	}
+	draftSummary, err := utils.Get[DraftSummary](ctx, utils.Db, utils.DraftSummaryPath(leagueId))
+	if err != nil {
+		return summary, err
+	}
+
+	rosters := buildRosters(draftSummary)
+	writer := utils.Db.NewBatchWriter(ctx, utils.BatchWriterOptionsFromEnv())
+	for _, user := range league.CurrentUsers {
+		roster, ok := rosters[user.OwnerId]
+		if !ok {
+			logging.FromContext(ctx).Warn("owner made no picks in the draft", "league_id", leagueId, "owner_id", user.OwnerId)
+			summary.OwnersWithoutPick = append(summary.OwnersWithoutPick, user.OwnerId)
+			continue
+		}
+		if problems := validateRoster(roster); len(problems) > 0 {
+			logging.FromContext(ctx).Warn("drafted roster can not be scored", "card_id", user.TokenId, "problems", problems)
+		}
+
+		token := utils.DraftTokenPath(user.TokenId)
+		writer.Set(token.Collection, token.DocumentId, map[string]any{
+			"Roster":            roster,
+			"CardId":            user.TokenId,
+			"OwnerId":           user.OwnerId,
+			"OwnerKey":          ownerKey(user.OwnerId),
+			"LeagueId":          leagueId,
+			"LeagueDisplayName": league.DisplayName,
+			"DraftType":         league.DraftType,
+			"Level":             league.Level,
+		}, firestore.MergeAll)
+		summary.CardsFinalized++
+
+		path := utils.CardScoresPath(leagueId, gameweek, user.TokenId)
+		_, err := utils.Get[CardScores](ctx, utils.Db, path)
+		if err == nil {
+			summary.CardScoresKept++
+			continue
+		}
+		if !errors.Is(err, utils.ErrNotFound) {
+			// the writes already queued are still committed, and their failures reported
+			closeErr := writer.Close()
+			if closeErr != nil {
+				return summary, fmt.Errorf("%w, and writing the queued cards failed: %v", err, closeErr)
+			}
+			return summary, err
+		}
+		writer.Set(path.Collection, path.DocumentId, newCardScores(user.TokenId, roster))
+		summary.CardScoresCreated++
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return summary, err
+	}
+
+	logging.FromContext(ctx).Info("finalized draft", "league_id", leagueId, "cards", summary.CardsFinalized, "card_scores_created", summary.CardScoresCreated)
+	return summary, nil
+}
+
+// finalizeInBackground finalizes a draft that just completed without holding
+// up the pick that completed it. The job is tracked so shutdown waits for it
+func finalizeInBackground(ctx context.Context, leagueId string) {
+	jobCtx, cancel := utils.JobContext(context.WithoutCancel(ctx))
+	go func() {
+		defer cancel()
+		_, err := FinalizeDraft(jobCtx, leagueId, FirstGameweekFromEnv())
+		if err != nil {
+			logging.FromContext(jobCtx).Error("error finalizing completed draft", "league_id", leagueId, "error", err)
+		}
+	}()
+}
+
+// FinalizeDraftEndPoint finalizes a completed draft again, for the gameweek in
+// ?week= or the first gameweek
+func FinalizeDraftEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := utils.JobContext(r.Context())
+	defer cancel()
+
+	gameweek := r.URL.Query().Get("week")
+	if gameweek == "" {
+		gameweek = FirstGameweekFromEnv()
+	}
+
+	summary, err := FinalizeDraft(ctx, chi.URLParam(r, "leagueId"), gameweek)
+	if err != nil {
+		writeDraftError(ctx, w, err)
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, summary)
+}
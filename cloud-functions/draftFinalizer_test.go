@@ -0,0 +1,55 @@
+package cloudfunctions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildRosters(t *testing.T) {
+	empty := func() *Roster {
+		return &Roster{DST: []RosterPlayer{}, QB: []RosterPlayer{}, RB: []RosterPlayer{}, TE: []RosterPlayer{}, WR: []RosterPlayer{}}
+	}
+	withQB := empty()
+	withQB.QB = []RosterPlayer{{Team: "BUF", PlayerId: "BUF-QB", DisplayName: "Buffalo QB"}}
+	withWRs := empty()
+	withWRs.WR = []RosterPlayer{{Team: "MIA", PlayerId: "MIA-WR"}, {Team: "MIA", PlayerId: "MIA-WR2"}}
+
+	tests := []struct {
+		name    string
+		summary DraftSummary
+		want    map[string]*Roster
+	}{
+		{
+			name:    "no picks",
+			summary: DraftSummary{},
+			want:    map[string]*Roster{},
+		},
+		{
+			// an owner with no picks gets no roster, which finalizing reports
+			name: "only owners that picked get a roster",
+			summary: DraftSummary{Summary: []PlayerInfo{
+				{PlayerId: "BUF-QB", DisplayName: "Buffalo QB", Team: "BUF", Position: "QB", OwnerAddress: "a", PickNum: 1},
+				{PlayerId: "MIA-WR", Team: "MIA", Position: "WR", OwnerAddress: "b", PickNum: 2},
+				{PlayerId: "MIA-WR2", Team: "MIA", Position: "WR", OwnerAddress: "b", PickNum: 3},
+			}},
+			want: map[string]*Roster{"a": withQB, "b": withWRs},
+		},
+		{
+			name: "unknown positions are dropped",
+			summary: DraftSummary{Summary: []PlayerInfo{
+				{PlayerId: "BUF-K", Team: "BUF", Position: "K", OwnerAddress: "a", PickNum: 1},
+				{PlayerId: "BUF-QB", DisplayName: "Buffalo QB", Team: "BUF", Position: "QB", OwnerAddress: "a", PickNum: 2},
+				{PlayerId: "MIA-LB", Team: "MIA", Position: "LB", OwnerAddress: "c", PickNum: 3},
+			}},
+			want: map[string]*Roster{"a": withQB, "c": empty()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildRosters(tt.summary)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildRosters() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
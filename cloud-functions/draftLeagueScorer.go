@@ -3,13 +3,22 @@ package cloudfunctions
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/metrics"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
 	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Score struct {
@@ -47,19 +56,28 @@ type Prizes struct {
 }
 
 type DraftToken struct {
-	Roster            *Roster `json:"roster"`
-	DraftType         string  `json:"_draftType"`
-	CardId            string  `json:"_cardId"`
-	ImageUrl          string  `json:"_imageUrl"`
-	Level             string  `json:"_level"`
-	OwnerId           string  `json:"_ownerId"`
-	LeagueId          string  `json:"_leagueId"`
-	LeagueDisplayName string  `json:"_leagueDisplayName"`
-	Rank              string  `json:"_rank"`
-	LeagueRank        string  `json:"_leagueRank"`
-	WeekScore         string  `json:"_weekScore"`
-	SeasonScore       string  `json:"_seasonScore"`
-	Prizes            Prizes  `json:"prizes"`
+	Roster    *Roster `json:"roster"`
+	DraftType string  `json:"_draftType"`
+	CardId    string  `json:"_cardId"`
+	ImageUrl  string  `json:"_imageUrl"`
+	Level     string  `json:"_level"`
+	OwnerId   string  `json:"_ownerId"`
+	// OwnerId lowercased, which owner lookups query so address casing never matters
+	OwnerKey          string `json:"_ownerKey"`
+	LeagueId          string `json:"_leagueId"`
+	LeagueDisplayName string `json:"_leagueDisplayName"`
+	Rank              string `json:"_rank"`
+	LeagueRank        string `json:"_leagueRank"`
+	WeekScore         string `json:"_weekScore"`
+	SeasonScore       string `json:"_seasonScore"`
+	// gameweek the scores and ranks on the token were written from
+	ScoreGameWeek string `json:"_scoreGameWeek"`
+	Prizes        Prizes `json:"prizes"`
+}
+
+// ownerKey is the OwnerKey stored next to an OwnerId
+func ownerKey(ownerId string) string {
+	return strings.ToLower(ownerId)
 }
 
 type ScoreObject struct {
@@ -86,6 +104,9 @@ type CardScores struct {
 	ScoreWeek           float64     `json:"scoreWeek"`
 	ScoreSeason         float64     `json:"scoreSeason"`
 	PrevWeekSeasonScore float64     `json:"prevWeekSeasonScore"`
+	// set once the week is scored, so a card that really scored 0 is told
+	// apart from one not scored yet
+	Scored bool `json:"scored"`
 }
 
 func sortPlayerArray(players []ScoreObject) []ScoreObject {
@@ -175,33 +196,157 @@ func calculateSeasonScoreFromSortedRoster(card CardScores, flex ScoreObject) Car
 	return card
 }
 
-func (s Scores) ScoreCards(token *DraftToken, gameweek string, wg *sync.WaitGroup, ticketQueue chan struct{}) {
+var errUnscorableRoster = errors.New("roster can not fill the starting lineup")
+
+// totalCardScores sorts each position by the players ScoreWeek, picks the best
+// remaining RB/TE/WR as the flex and sets the week and season totals of the
+// card. A roster short of a starter or the flex returns errUnscorableRoster
+func totalCardScores(cardScores CardScores) (CardScores, error) {
+	counts := map[string]int{
+		"DST": len(cardScores.Roster.DST),
+		"QB":  len(cardScores.Roster.QB),
+		"RB":  len(cardScores.Roster.RB),
+		"TE":  len(cardScores.Roster.TE),
+		"WR":  len(cardScores.Roster.WR),
+	}
+	for position, min := range minRosterPositions {
+		if counts[position] < min {
+			return cardScores, fmt.Errorf("%w: %d %s but needs at least %d", errUnscorableRoster, counts[position], position, min)
+		}
+	}
+
+	cardScores.Roster.DST = sortPlayerArray(cardScores.Roster.DST)
+	cardScores.Roster.QB = sortPlayerArray(cardScores.Roster.QB)
+	cardScores.Roster.RB = sortPlayerArray(cardScores.Roster.RB)
+	cardScores.Roster.TE = sortPlayerArray(cardScores.Roster.TE)
+	cardScores.Roster.WR = sortPlayerArray(cardScores.Roster.WR)
+
+	flexArray := make([]ScoreObject, 0)
+
+	for i := 2; i < len(cardScores.Roster.RB); i++ {
+		flexArray = append(flexArray, cardScores.Roster.RB[i])
+	}
+	for i := 1; i < len(cardScores.Roster.TE); i++ {
+		flexArray = append(flexArray, cardScores.Roster.TE[i])
+	}
+	for i := 2; i < len(cardScores.Roster.WR); i++ {
+		flexArray = append(flexArray, cardScores.Roster.WR[i])
+	}
+
+	if len(flexArray) == 0 {
+		return cardScores, fmt.Errorf("%w: no player left for the flex spot", errUnscorableRoster)
+	}
+	sortedFlex := sortPlayerArray(flexArray)
+	flexPlayer := sortedFlex[0]
+
+	return calculateSeasonScoreFromSortedRoster(cardScores, flexPlayer), nil
+}
+
+type CardScoreChange struct {
+	CardId            string  `json:"cardId"`
+	LeagueId          string  `json:"leagueId"`
+	ScoreWeekBefore   float64 `json:"scoreWeekBefore"`
+	ScoreWeekAfter    float64 `json:"scoreWeekAfter"`
+	ScoreSeasonBefore float64 `json:"scoreSeasonBefore"`
+	ScoreSeasonAfter  float64 `json:"scoreSeasonAfter"`
+}
+
+type ScoringSummary struct {
+	GameWeek     string            `json:"gameWeek"`
+	DryRun       bool              `json:"dryRun"`
+	CardsScored  int               `json:"cardsScored"`
+	CardsSkipped int               `json:"cardsSkipped"`
+	CardsFailed  int               `json:"cardsFailed"`
+	Changes      []CardScoreChange `json:"changes"`
+	Cancelled    bool              `json:"cancelled,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	lock         sync.Mutex
+	standings    tokenStandings
+}
+
+func (summary *ScoringSummary) recordScored(change *CardScoreChange) {
+	summary.lock.Lock()
+	defer summary.lock.Unlock()
+	summary.CardsScored++
+	if change != nil {
+		summary.Changes = append(summary.Changes, *change)
+	}
+}
+
+func (summary *ScoringSummary) recordSkipped() {
+	summary.lock.Lock()
+	defer summary.lock.Unlock()
+	summary.CardsSkipped++
+}
+
+func (summary *ScoringSummary) recordFailed() {
+	summary.lock.Lock()
+	defer summary.lock.Unlock()
+	summary.CardsFailed++
+}
+
+// recordWriteFailures moves cards whose score write failed after they were
+// counted as scored over to the failed count
+func (summary *ScoringSummary) recordWriteFailures(failed int) {
+	summary.lock.Lock()
+	defer summary.lock.Unlock()
+	summary.CardsScored -= failed
+	summary.CardsFailed += failed
+}
+
+// closeWriter waits for the queued card scores to be committed and counts the
+// cards that could not be written as failed
+func (summary *ScoringSummary) closeWriter(ctx context.Context, writer *utils.BatchWriter) {
+	err := writer.Close()
+	if batchErr, ok := err.(*utils.BatchWriteError); ok {
+		logging.FromContext(ctx).Error("error writing card scores", "failed", len(batchErr.Failed), "error", batchErr)
+		// a failed draft token write only leaves its metadata behind, the card itself was scored
+		failedCards := 0
+		for path := range batchErr.Failed {
+			if !strings.HasPrefix(path, utils.DraftTokensCollection+"/") {
+				failedCards++
+			}
+		}
+		summary.recordWriteFailures(failedCards)
+	}
+}
+
+// ScoreCards scores the card of a single draft token for the gameweek, queues
+// the new score on the writer and records any difference to its stored score
+// in the summary, which also collects the totals written to the token.
+// Nothing is queued when the summary is a dry run
+func (s Scores) ScoreCards(ctx context.Context, token *DraftToken, gameweek string, summary *ScoringSummary, writer *utils.BatchWriter) {
+	var err error
+	ctx, span := tracing.Start(ctx, "ScoreCards", attribute.String("card_id", token.CardId), attribute.String("league_id", token.LeagueId))
 	defer func() {
-		<-ticketQueue
-		wg.Done()
+		tracing.End(span, err)
 	}()
+
 	scoresMap := make(map[string]Score)
 	for i := 0; i < len(s.FantasyPoints); i++ {
 		scoresMap[s.FantasyPoints[i].Team] = s.FantasyPoints[i]
 	}
 
-	var cardScores CardScores
-	err := utils.Db.ReadDocument(fmt.Sprintf("drafts/%s/scores/%s/cards", token.LeagueId, gameweek), token.CardId, &cardScores)
+	path := utils.CardScoresPath(token.LeagueId, gameweek, token.CardId)
+	cardScores, err := utils.Get[CardScores](ctx, utils.Db, path)
 	if err != nil {
-		fmt.Println("Error reading card scores: ", err)
+		if ctx.Err() != nil {
+			// the run was cancelled so this card was never attempted rather than failed
+			return
+		}
+		logging.FromContext(ctx).Error("error reading card scores", "card_id", token.CardId, "league_id", token.LeagueId, "error", err)
+		summary.recordFailed()
 		return
 	}
+	before := cardScores
 
 	for i := 0; i < len(cardScores.Roster.DST); i++ {
 		cardScores.Roster.DST[i].ScoreWeek = scoresMap[cardScores.Roster.DST[i].Team].DST
 	}
 
-	cardScores.Roster.DST = sortPlayerArray(cardScores.Roster.DST)
-
 	for i := 0; i < len(cardScores.Roster.QB); i++ {
 		cardScores.Roster.QB[i].ScoreWeek = scoresMap[cardScores.Roster.QB[i].Team].QB
 	}
-	cardScores.Roster.QB = sortPlayerArray(cardScores.Roster.QB)
 
 	for i := 0; i < len(cardScores.Roster.RB); i++ {
 		if res := strings.Split(cardScores.Roster.RB[i].PlayerId, "-"); res[len(res)-1] == "RB2" {
@@ -211,14 +356,10 @@ func (s Scores) ScoreCards(token *DraftToken, gameweek string, wg *sync.WaitGrou
 		}
 	}
 
-	cardScores.Roster.RB = sortPlayerArray(cardScores.Roster.RB)
-
 	for i := 0; i < len(cardScores.Roster.TE); i++ {
 		cardScores.Roster.TE[i].ScoreWeek = scoresMap[cardScores.Roster.TE[i].Team].TE
 	}
 
-	cardScores.Roster.TE = sortPlayerArray(cardScores.Roster.TE)
-
 	for i := 0; i < len(cardScores.Roster.WR); i++ {
 		if res := strings.Split(cardScores.Roster.WR[i].PlayerId, "-"); res[len(res)-1] == "WR2" {
 			cardScores.Roster.WR[i].ScoreWeek = scoresMap[cardScores.Roster.WR[i].Team].WR2
@@ -227,65 +368,197 @@ func (s Scores) ScoreCards(token *DraftToken, gameweek string, wg *sync.WaitGrou
 		}
 	}
 
-	cardScores.Roster.WR = sortPlayerArray(cardScores.Roster.WR)
+	cardScores.Scored = true
+	cardScores, err = totalCardScores(cardScores)
+	if err != nil {
+		logging.FromContext(ctx).Error("error totalling card scores", "card_id", token.CardId, "league_id", token.LeagueId, "error", err)
+		summary.recordFailed()
+		return
+	}
 
-	flexArray := make([]ScoreObject, 0)
+	var change *CardScoreChange
+	if before.ScoreWeek != cardScores.ScoreWeek || before.ScoreSeason != cardScores.ScoreSeason {
+		change = &CardScoreChange{
+			CardId:            token.CardId,
+			LeagueId:          token.LeagueId,
+			ScoreWeekBefore:   before.ScoreWeek,
+			ScoreWeekAfter:    cardScores.ScoreWeek,
+			ScoreSeasonBefore: before.ScoreSeason,
+			ScoreSeasonAfter:  cardScores.ScoreSeason,
+		}
+	}
 
-	for i := 2; i < len(cardScores.Roster.RB); i++ {
-		flexArray = append(flexArray, cardScores.Roster.RB[i])
+	if summary.DryRun {
+		summary.recordScored(change)
+		return
 	}
-	for i := 1; i < len(cardScores.Roster.TE); i++ {
-		flexArray = append(flexArray, cardScores.Roster.TE[i])
+
+	writer.Set(path.Collection, path.DocumentId, cardScores)
+	summary.standings.add(token, gameweek, cardScores)
+
+	summary.recordScored(change)
+	logging.FromContext(ctx).Debug("finished scoring card", "card_id", token.CardId, "score_week", cardScores.ScoreWeek)
+}
+
+// isLatestGameweek reports whether gameweek is not before the gameweek the
+// scores on the token were written from, so scoring an older week again
+// leaves the token alone
+func isLatestGameweek(token *DraftToken, gameweek string) bool {
+	week, err := strconv.Atoi(gameweek)
+	if err != nil {
+		return true
 	}
-	for i := 2; i < len(cardScores.Roster.WR); i++ {
-		flexArray = append(flexArray, cardScores.Roster.WR[i])
+	last, err := strconv.Atoi(token.ScoreGameWeek)
+	if err != nil {
+		return true
 	}
+	return week >= last
+}
 
-	sortedFlex := sortPlayerArray(flexArray)
-	flexPlayer := sortedFlex[0]
+type tokenScore struct {
+	cardId      string
+	leagueId    string
+	gameweek    string
+	scoreWeek   float64
+	scoreSeason float64
+}
 
-	cardScores = calculateSeasonScoreFromSortedRoster(cardScores, flexPlayer)
+// tokenStandings collects the totals of the cards scored for their latest
+// gameweek, which are ranked and written to the tokens once every card is in
+type tokenStandings struct {
+	lock   sync.Mutex
+	scores []tokenScore
+}
 
-	err = utils.Db.CreateOrUpdateDocument(fmt.Sprintf("drafts/%s/scores/%s/cards", token.LeagueId, gameweek), token.CardId, cardScores)
-	if err != nil {
-		fmt.Println("Error updating score for card: ", err)
+func (standings *tokenStandings) add(token *DraftToken, gameweek string, cardScores CardScores) {
+	if !isLatestGameweek(token, gameweek) {
 		return
 	}
+	standings.lock.Lock()
+	defer standings.lock.Unlock()
+	standings.scores = append(standings.scores, tokenScore{
+		cardId:      token.CardId,
+		leagueId:    token.LeagueId,
+		gameweek:    gameweek,
+		scoreWeek:   cardScores.ScoreWeek,
+		scoreSeason: cardScores.ScoreSeason,
+	})
+}
 
-	fmt.Println("finished scoring card ", token.CardId)
+// write ranks the collected cards by season score, overall and within their
+// league, and queues the scores and ranks on each token for its metadata and
+// card image. Cards with the same season score share a rank
+func (standings *tokenStandings) write(writer *utils.BatchWriter) {
+	standings.lock.Lock()
+	defer standings.lock.Unlock()
+
+	scores := standings.scores
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].scoreSeason != scores[j].scoreSeason {
+			return scores[i].scoreSeason > scores[j].scoreSeason
+		}
+		return scores[i].cardId < scores[j].cardId
+	})
+
+	rank := 0
+	leagueRanks := make(map[string]int)
+	leagueCounts := make(map[string]int)
+	leagueLast := make(map[string]float64)
+	for i, score := range scores {
+		if i == 0 || score.scoreSeason != scores[i-1].scoreSeason {
+			rank = i + 1
+		}
+		leagueCounts[score.leagueId]++
+		if last, ok := leagueLast[score.leagueId]; !ok || last != score.scoreSeason {
+			leagueRanks[score.leagueId] = leagueCounts[score.leagueId]
+			leagueLast[score.leagueId] = score.scoreSeason
+		}
+
+		tokenPath := utils.DraftTokenPath(score.cardId)
+		writer.Set(tokenPath.Collection, tokenPath.DocumentId, map[string]any{
+			"WeekScore":     strconv.FormatFloat(score.scoreWeek, 'f', 2, 64),
+			"SeasonScore":   strconv.FormatFloat(score.scoreSeason, 'f', 2, 64),
+			"ScoreGameWeek": score.gameweek,
+			"Rank":          strconv.Itoa(rank),
+			"LeagueRank":    strconv.Itoa(leagueRanks[score.leagueId]),
+		}, firestore.MergeAll)
+	}
 }
 
-func ScoreDraftTokens(gameweek string, scores Scores) error {
-	tokensResponse, err := utils.Db.Client.Collection("draftTokens").Documents(context.Background()).GetAll()
-	if err != nil {
-		fmt.Println("Error reading all draft tokens")
+// scoringLockKey is the run lock held while the card scores of a gameweek are written
+func scoringLockKey(gameweek string) string {
+	return "scoreDraftTokens-" + gameweek
+}
+
+// ScoreDraftTokens scores every rostered draft token for the gameweek. With
+// dryRun set all reads and scoring happen but no card scores are written
+func ScoreDraftTokens(ctx context.Context, gameweek string, scores Scores, dryRun bool) (summary *ScoringSummary, err error) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "ScoreDraftTokens", attribute.String("gameweek", gameweek), attribute.Bool("dry_run", dryRun))
+	defer func() {
+		metrics.RecordScoringRun(summary.CardsScored, summary.CardsFailed, summary.CardsSkipped)
+		metrics.ObserveJob("score_draft_tokens", start, err)
+		span.SetAttributes(
+			attribute.Int("cards.scored", summary.CardsScored),
+			attribute.Int("cards.failed", summary.CardsFailed),
+			attribute.Int("cards.skipped", summary.CardsSkipped),
+		)
+		tracing.End(span, err)
+	}()
+
+	ctx = logging.WithRun(ctx, "score_draft_tokens")
+	logging.FromContext(ctx).Info("scoring draft tokens", "gameweek", gameweek, "dry_run", dryRun)
+
+	summary = &ScoringSummary{
+		GameWeek: gameweek,
+		DryRun:   dryRun,
+		Changes:  make([]CardScoreChange, 0),
 	}
 
-	ticket := make(chan struct{}, 40)
+	// a dry run writes nothing so it does not need to hold the gameweek
+	if !dryRun {
+		var lock *utils.RunLock
+		ctx, lock, err = utils.Db.AcquireRunLock(ctx, scoringLockKey(gameweek), utils.LockTTLFromEnv(), utils.LockWaitFromEnv())
+		if err != nil {
+			return summary, err
+		}
+		defer func() {
+			releaseErr := lock.Release(ctx)
+			if releaseErr != nil {
+				logging.FromContext(ctx).Warn("error releasing run lock", "error", releaseErr)
+			}
+		}()
+	}
 
-	wg := sync.WaitGroup{}
+	writer := utils.Db.NewBatchWriter(ctx, utils.BatchWriterOptionsFromEnv())
 
-	for _, snapshot := range tokensResponse {
+	err = utils.Db.ForEachDocument(ctx, utils.Db.Client.Collection(utils.DraftTokensCollection).Query, utils.PageSizeFromEnv(), utils.WorkersFromEnv(), func(snapshot *firestore.DocumentSnapshot) error {
 		var token DraftToken
-		err = snapshot.DataTo(&token)
+		err := snapshot.DataTo(&token)
 		if err != nil {
-			fmt.Println("Error reading snapshot into draft token: ", err)
+			logging.FromContext(ctx).Error("error reading snapshot into draft token", "document_id", snapshot.Ref.ID, "error", err)
 			return err
 		}
-		if len(token.Roster.DST) == 0 {
-			fmt.Println("This card does not have a roster card ", token.CardId)
-			continue
+		if token.Roster == nil || len(token.Roster.DST) == 0 {
+			logging.FromContext(ctx).Debug("card does not have a roster yet, skipping it", "card_id", token.CardId)
+			summary.recordSkipped()
+			return nil
 		}
-		ticket <- struct{}{} // would block if guard channel is already filled
-		wg.Add(1)
-		go scores.ScoreCards(&token, gameweek, &wg, ticket)
+		scores.ScoreCards(ctx, &token, gameweek, summary, writer)
+		return nil
+	})
+	// ranks are only meaningful once every card is scored
+	if err == nil {
+		summary.standings.write(writer)
 	}
-	fmt.Println("Looped through all draft tokens and are waiting for them to finish")
-
-	wg.Wait()
-	fmt.Println("Finished scoring all draft tokens and returning to http function")
+	summary.closeWriter(ctx, writer)
+	if err != nil {
+		logging.FromContext(ctx).Error("error streaming draft tokens", "error", err)
+		return summary, err
+	}
+	logging.FromContext(ctx).Info("finished scoring all draft tokens", "scored", summary.CardsScored, "failed", summary.CardsFailed, "skipped", summary.CardsSkipped)
 
-	return nil
+	return summary, nil
 }
 
 type ScoreDraftTokensEndpoint struct {
@@ -298,7 +571,7 @@ func ScoreDraftTokensEndPoint(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewDecoder(r.Body).Decode(&reqData)
 	if err != nil {
-		fmt.Println("Error decoding request body in score draft token endpoint: ", err)
+		logging.FromContext(r.Context()).Warn("error decoding request body in score draft token endpoint", "error", err)
 		http.Error(w, fmt.Sprint("Error decoding request body in score draft token endpoint: ", err), http.StatusBadRequest)
 		return
 	}
@@ -307,22 +580,63 @@ func ScoreDraftTokensEndPoint(w http.ResponseWriter, r *http.Request) {
 		FantasyPoints: reqData.Scores,
 	}
 
-	err = ScoreDraftTokens(reqData.GameWeek, scores)
+	ctx, cancel := utils.JobContext(r.Context())
+	defer cancel()
+
+	summary, err := ScoreDraftTokens(ctx, reqData.GameWeek, scores, isDryRun(r))
+	if errors.Is(err, utils.ErrLockHeld) {
+		logging.FromContext(ctx).Warn("gameweek is already being scored", "gameweek", reqData.GameWeek, "error", err)
+		summary.Error = err.Error()
+		writeJSON(ctx, w, http.StatusConflict, summary)
+		return
+	}
+	if err != nil && ctx.Err() != nil {
+		logging.FromContext(ctx).Warn("scoring was cancelled before every draft token was scored", "scored", summary.CardsScored, "error", err)
+		summary.Cancelled = true
+		summary.Error = err.Error()
+		writeJSON(ctx, w, http.StatusGatewayTimeout, summary)
+		return
+	}
 	if err != nil {
-		fmt.Println("Error scoring tokens in score draft token endpoint: ", err)
+		logging.FromContext(ctx).Error("error scoring tokens in score draft token endpoint", "error", err)
 		http.Error(w, fmt.Sprint("Error scoring tokens in score draft token endpoint: ", err), http.StatusInternalServerError)
 		return
 	}
 
-	data := []byte("Finished scoring draft tokens")
+	data, err := json.Marshal(summary)
+	if err != nil {
+		logging.FromContext(ctx).Error("error marshalling scoring summary", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	_, err = w.Write(data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Println("Error writing data responde: ", err)
+		logging.FromContext(ctx).Error("error writing scoring response", "error", err)
 		return
 	}
-
-	fmt.Println("Returned from ScoreDraftTokensEndpoint")
 	return
 }
+
+// isDryRun reports whether the request asked for a dry run with ?dryRun=true
+func isDryRun(r *http.Request) bool {
+	dryRun, err := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	return err == nil && dryRun
+}
+
+// writeJSON writes v as the json body of a response with the given status
+func writeJSON(ctx context.Context, w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logging.FromContext(ctx).Error("error marshalling response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(data)
+	if err != nil {
+		logging.FromContext(ctx).Error("error writing response", "error", err)
+	}
+}
@@ -0,0 +1,188 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CJPotter10/sbs-cloud-functions-api/events"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/go-chi/chi"
+)
+
+const (
+	DraftEventState      = "state"
+	DraftEventPick       = "pick"
+	DraftEventOnTheClock = "on_the_clock"
+	DraftEventTimer      = "timer"
+	DraftEventComplete   = "draft_complete"
+)
+
+// events kept per draft for clients that reconnect
+const draftEventHistory = 256
+
+// DraftEvents carries the events of every draft, one topic per league id
+var DraftEvents events.Broker = events.NewHub(draftEventHistory)
+
+type OnTheClockEvent struct {
+	LeagueId     string    `json:"leagueId"`
+	PickNum      int       `json:"pickNum"`
+	Round        int       `json:"round"`
+	OwnerAddress string    `json:"ownerAddress"`
+	Deadline     time.Time `json:"deadline"`
+}
+
+type TimerEvent struct {
+	PickNum      int    `json:"pickNum"`
+	OwnerAddress string `json:"ownerAddress"`
+	SecondsLeft  int    `json:"secondsLeft"`
+}
+
+func onTheClockEvent(state DraftState) OnTheClockEvent {
+	owner, round := state.OnTheClock(state.CurrentPickNum)
+	return OnTheClockEvent{
+		LeagueId:     state.LeagueId,
+		PickNum:      state.CurrentPickNum,
+		Round:        round,
+		OwnerAddress: owner,
+		Deadline:     state.PickDeadline,
+	}
+}
+
+func publishDraftEvent(ctx context.Context, leagueId string, eventType string, data any) {
+	event, err := DraftEvents.Publish(leagueId, eventType, data)
+	if err != nil {
+		logging.FromContext(ctx).Error("error publishing draft event", "league_id", leagueId, "event", eventType, "error", err)
+		return
+	}
+	logging.FromContext(ctx).Debug("published draft event", "league_id", leagueId, "event", eventType, "seq", event.Seq)
+}
+
+// writeSSE writes one server-sent event. Events without a sequence number,
+// like timer ticks, are left out of the ids a client resumes from
+func writeSSE(w io.Writer, seq int64, eventType string, data []byte) error {
+	if seq > 0 {
+		_, err := fmt.Fprintf(w, "id: %d\n", seq)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data)
+	return err
+}
+
+// lastEventId reads the sequence number to replay from, sent by EventSource in
+// the Last-Event-ID header on reconnect or given as ?after= by other clients
+func lastEventId(r *http.Request) int64 {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("after")
+	}
+	seq, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seq < 0 {
+		return 0
+	}
+	return seq
+}
+
+// DraftEventsEndPoint streams the events of a draft as server-sent events. A
+// new client, or one that missed more than is kept, first gets the whole draft
+// as a state event instead of a replay. A reconnecting client gets the events
+// after its last one.
+// While a pick is on the clock a timer event is sent every second
+func DraftEventsEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	leagueId := chi.URLParam(r, "leagueId")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// subscribe before reading the draft so no event falls between the two
+	afterSeq := lastEventId(r)
+	sub := DraftEvents.Subscribe(leagueId, afterSeq)
+	defer sub.Cancel()
+
+	view, err := GetDraft(ctx, leagueId)
+	if err != nil {
+		writeDraftError(ctx, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	clock := onTheClockEvent(view.State)
+	clockRunning := view.State.Status != DraftStatusComplete
+
+	replayed := 0
+	if afterSeq == 0 || sub.Gap {
+		// the state already holds every replayed pick, and carries the topic's
+		// sequence number so a reconnect resumes after it
+		data, err := json.Marshal(view)
+		if err == nil {
+			err = writeSSE(w, sub.Seq, DraftEventState, data)
+		}
+		if err != nil {
+			logging.FromContext(ctx).Warn("error writing draft state event", "league_id", leagueId, "error", err)
+			return
+		}
+	} else {
+		for _, event := range sub.Replay {
+			err = writeSSE(w, event.Seq, event.Type, event.Data)
+			if err != nil {
+				return
+			}
+		}
+		replayed = len(sub.Replay)
+	}
+	flusher.Flush()
+	logging.FromContext(ctx).Info("draft room client connected", "league_id", leagueId, "after_seq", afterSeq, "replayed", replayed, "gap", sub.Gap)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				// dropped for falling behind or shutting down, the client reconnects
+				return
+			}
+			switch event.Type {
+			case DraftEventOnTheClock:
+				if json.Unmarshal(event.Data, &clock) == nil {
+					clockRunning = true
+				}
+			case DraftEventComplete:
+				clockRunning = false
+			}
+			err = writeSSE(w, event.Seq, event.Type, event.Data)
+		case <-ticker.C:
+			if !clockRunning {
+				continue
+			}
+			secondsLeft := int(time.Until(clock.Deadline).Round(time.Second) / time.Second)
+			if secondsLeft < 0 {
+				secondsLeft = 0
+			}
+			data, _ := json.Marshal(TimerEvent{PickNum: clock.PickNum, OwnerAddress: clock.OwnerAddress, SecondsLeft: secondsLeft})
+			err = writeSSE(w, 0, DraftEventTimer, data)
+		}
+		if err != nil {
+			logging.FromContext(ctx).Debug("draft room client went away", "league_id", leagueId, "error", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,248 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"github.com/go-chi/chi"
+)
+
+const (
+	JobADP             = "adp"
+	JobScoreGameweek   = "scoreGameweek"
+	JobRecomputeSeason = "recomputeSeason"
+	JobAutopick        = "autopick"
+	JobCancelLeagues   = "cancelUnfilledLeagues"
+	JobRolloverWeek    = "rolloverWeek"
+	JobSyncOwnership   = "syncOwnership"
+	JobStacking        = "stackingAnalysis"
+)
+
+// JobRequest is the payload of a pub/sub message or a cloud scheduler call
+// asking for one of the background jobs to run
+type JobRequest struct {
+	Job         string  `json:"job"`
+	GameWeek    string  `json:"gameWeek,omitempty"`
+	Scores      []Score `json:"scores,omitempty"`
+	ThroughWeek int     `json:"throughWeek,omitempty"`
+	DryRun      bool    `json:"dryRun,omitempty"`
+}
+
+type PubSubMessage struct {
+	// encoding/json base64 decodes the data field into the byte slice
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes"`
+	MessageId   string            `json:"messageId"`
+	PublishTime time.Time         `json:"publishTime"`
+}
+
+type PubSubPushEnvelope struct {
+	Message      PubSubMessage `json:"message"`
+	Subscription string        `json:"subscription"`
+}
+
+var errInvalidJob = errors.New("invalid job request")
+
+// loadFantasyPoints reads the fantasy points of a gameweek stored at
+// fantasyPoints/{gameweek} for scheduled scoring runs that do not carry scores
+func loadFantasyPoints(ctx context.Context, gameweek string) (Scores, error) {
+	scores, err := utils.Get[Scores](ctx, utils.Db, utils.FantasyPointsPath(gameweek))
+	if err != nil {
+		return scores, err
+	}
+	if len(scores.FantasyPoints) == 0 {
+		return scores, fmt.Errorf("fantasyPoints/%s has no scores", gameweek)
+	}
+	return scores, nil
+}
+
+// validateJobRequest checks that req names a known job and carries what that job needs
+func validateJobRequest(req JobRequest) error {
+	switch req.Job {
+	case JobADP, JobAutopick, JobCancelLeagues, JobSyncOwnership, JobStacking:
+		return nil
+	case JobScoreGameweek, JobRolloverWeek:
+		if req.GameWeek == "" {
+			return fmt.Errorf("%w: %s needs a gameWeek", errInvalidJob, req.Job)
+		}
+		return nil
+	case JobRecomputeSeason:
+		if req.ThroughWeek <= 0 {
+			return fmt.Errorf("%w: %s needs a throughWeek", errInvalidJob, req.Job)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unknown job %q", errInvalidJob, req.Job)
+}
+
+// RunJob runs the job named in req and returns its summary
+func RunJob(ctx context.Context, req JobRequest) (any, error) {
+	err := validateJobRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Job {
+	case JobADP:
+		return ComputeADP(ctx, req.DryRun)
+	case JobScoreGameweek:
+		scores := Scores{FantasyPoints: req.Scores}
+		if len(scores.FantasyPoints) == 0 {
+			var err error
+			scores, err = loadFantasyPoints(ctx, req.GameWeek)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ScoreDraftTokens(ctx, req.GameWeek, scores, req.DryRun)
+	case JobRecomputeSeason:
+		return RecomputeSeason(ctx, GameweekIds(req.ThroughWeek))
+	case JobRolloverWeek:
+		return RolloverWeek(ctx, req.GameWeek, req.DryRun)
+	case JobAutopick:
+		return AutopickExpiredDrafts(ctx)
+	case JobCancelLeagues:
+		return CancelUnfilledLeagues(ctx, req.DryRun)
+	case JobSyncOwnership:
+		source, err := TransferSourceFromEnv()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidJob, err)
+		}
+		return SyncOwnership(ctx, source)
+	case JobStacking:
+		return AnalyzeStacking(ctx, req.DryRun)
+	}
+	return nil, fmt.Errorf("%w: unknown job %q", errInvalidJob, req.Job)
+}
+
+// jobRequestFromMessage decodes the job request carried in the message data.
+// A job attribute on the message is used when the data does not name one
+func jobRequestFromMessage(message PubSubMessage) (JobRequest, error) {
+	var req JobRequest
+	if len(message.Data) > 0 {
+		err := json.Unmarshal(message.Data, &req)
+		if err != nil {
+			return req, fmt.Errorf("message data is not a job request: %v", err)
+		}
+	}
+	if req.Job == "" {
+		req.Job = message.Attributes["job"]
+	}
+	if req.GameWeek == "" {
+		req.GameWeek = message.Attributes["gameWeek"]
+	}
+	return req, nil
+}
+
+// PubSubPushEndPoint runs the job carried by a pub/sub push subscription.
+// Messages are deduplicated by message id, so a redelivery of a message that
+// is running or already ran is acknowledged without running it again. A
+// failed job responds with an error so pub/sub redelivers it. Malformed
+// messages are acknowledged because retrying them can never succeed
+func PubSubPushEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := utils.JobContext(r.Context())
+	defer cancel()
+
+	var envelope PubSubPushEnvelope
+	err := json.NewDecoder(r.Body).Decode(&envelope)
+	if err != nil {
+		logging.FromContext(ctx).Warn("dropping pub/sub push envelope that can not be decoded", "error", err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	message := envelope.Message
+	ctx = logging.With(ctx, "message_id", message.MessageId, "subscription", envelope.Subscription)
+	if message.MessageId == "" {
+		logging.FromContext(ctx).Warn("dropping pub/sub message with no message id")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	req, err := jobRequestFromMessage(message)
+	if err == nil {
+		err = validateJobRequest(req)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Warn("dropping malformed pub/sub message", "error", err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	claimed, err := utils.Db.ClaimMessage(ctx, message.MessageId, envelope.Subscription)
+	if err != nil {
+		logging.FromContext(ctx).Error("error claiming pub/sub message", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		logging.FromContext(ctx).Info("skipping duplicate pub/sub message", "job", req.Job)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	summary, jobErr := RunJob(ctx, req)
+
+	// the run context may have expired so the outcome is recorded on a fresh one
+	completeCtx, cancelComplete := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancelComplete()
+	err = utils.Db.CompleteMessage(completeCtx, message.MessageId, jobErr)
+	if err != nil {
+		logging.FromContext(ctx).Error("error recording pub/sub message outcome", "error", err)
+	}
+
+	writeJobResult(ctx, w, req, summary, jobErr)
+}
+
+// SchedulerEndPoint runs the job in the url for a cloud scheduler call, with
+// an optional json body for the rest of the job request
+func SchedulerEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := utils.JobContext(r.Context())
+	defer cancel()
+
+	var req JobRequest
+	body, err := io.ReadAll(r.Body)
+	if err == nil && len(body) > 0 {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Warn("error decoding scheduler request body", "error", err)
+		http.Error(w, fmt.Sprint("error decoding scheduler request body: ", err), http.StatusBadRequest)
+		return
+	}
+	req.Job = chi.URLParam(r, "job")
+	if isDryRun(r) {
+		req.DryRun = true
+	}
+
+	ctx = logging.With(ctx, "scheduler_job", r.Header.Get("X-CloudScheduler-JobName"))
+	summary, err := RunJob(ctx, req)
+	writeJobResult(ctx, w, req, summary, err)
+}
+
+func writeJobResult(ctx context.Context, w http.ResponseWriter, req JobRequest, summary any, err error) {
+	switch {
+	case errors.Is(err, errInvalidJob):
+		logging.FromContext(ctx).Warn("invalid job requested", "job", req.Job, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, utils.ErrLockHeld):
+		// a pub/sub push gets redelivered later, which queues it behind the run holding the lock
+		logging.FromContext(ctx).Warn("job is already running", "job", req.Job, "error", err)
+		writeJSON(ctx, w, http.StatusConflict, map[string]any{"job": req.Job, "error": err.Error(), "summary": summary})
+	case err != nil && ctx.Err() != nil:
+		logging.FromContext(ctx).Warn("job was cancelled before it finished", "job", req.Job, "error", err)
+		writeJSON(ctx, w, http.StatusGatewayTimeout, map[string]any{"job": req.Job, "error": err.Error(), "summary": summary})
+	case err != nil:
+		logging.FromContext(ctx).Error("job failed", "job", req.Job, "error", err)
+		writeJSON(ctx, w, http.StatusInternalServerError, map[string]any{"job": req.Job, "error": err.Error(), "summary": summary})
+	default:
+		writeJSON(ctx, w, http.StatusOK, map[string]any{"job": req.Job, "summary": summary})
+	}
+}
@@ -0,0 +1,57 @@
+package cloudfunctions
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+)
+
+type LeagueExport struct {
+	League     League                `json:"league"`
+	Summary    *DraftSummary         `json:"summary,omitempty"`
+	Tokens     []DraftToken          `json:"tokens"`
+	CardScores map[string]CardScores `json:"cardScores,omitempty"`
+}
+
+// ExportLeague gathers the league document, its draft summary and the draft
+// tokens drafted in it. When gameweek is set the card scores of that week are
+// included as well
+func ExportLeague(ctx context.Context, leagueId string, gameweek string) (LeagueExport, error) {
+	var export LeagueExport
+
+	league, err := utils.Get[League](ctx, utils.Db, utils.DraftPath(leagueId))
+	if err != nil {
+		return export, err
+	}
+	export.League = league
+
+	summary, err := utils.Get[DraftSummary](ctx, utils.Db, utils.DraftSummaryPath(leagueId))
+	if err != nil {
+		logging.FromContext(ctx).Warn("no draft summary found for league", "league_id", leagueId, "error", err)
+	} else {
+		export.Summary = &summary
+	}
+
+	export.Tokens, err = utils.Query[DraftToken](ctx, utils.Db, utils.Db.Client.Collection(utils.DraftTokensCollection).Where("LeagueId", "==", leagueId))
+	if err != nil {
+		return export, fmt.Errorf("error reading draft tokens for league %s: %v", leagueId, err)
+	}
+
+	if gameweek == "" {
+		return export, nil
+	}
+
+	export.CardScores = make(map[string]CardScores)
+	for _, token := range export.Tokens {
+		cardScores, err := utils.Get[CardScores](ctx, utils.Db, utils.CardScoresPath(leagueId, gameweek, token.CardId))
+		if err != nil {
+			logging.FromContext(ctx).Warn("no card scores found for card", "card_id", token.CardId, "error", err)
+			continue
+		}
+		export.CardScores[token.CardId] = cardScores
+	}
+
+	return export, nil
+}
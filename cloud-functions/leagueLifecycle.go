@@ -0,0 +1,346 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const RefundStatusPending = "pending"
+
+var (
+	errInvalidLeague   = errors.New("invalid league")
+	errLeagueExists    = errors.New("league already exists")
+	errLeagueFull      = errors.New("league is full")
+	errLeagueCancelled = errors.New("league was cancelled")
+	errLeagueStarted   = errors.New("league has already started")
+	errAlreadyJoined   = errors.New("owner has already joined the league")
+	errTokenInUse      = errors.New("token is already in the league")
+)
+
+// Refund is owed to every user of a league cancelled for not filling. The
+// payment side picks up pending refunds and marks them paid
+type Refund struct {
+	LeagueId  string    `json:"leagueId"`
+	OwnerId   string    `json:"ownerId"`
+	TokenId   string    `json:"tokenId"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type CreateLeagueRequest struct {
+	LeagueId    string    `json:"leagueId"`
+	DisplayName string    `json:"displayName"`
+	MaxPlayers  int       `json:"maxPlayers"`
+	StartDate   time.Time `json:"startDate"`
+	EndDate     time.Time `json:"endDate"`
+	DraftType   string    `json:"draftType"`
+	Level       string    `json:"level"`
+}
+
+// CreateLeague creates an open league with no users. A league id is
+// generated when the request does not carry one
+func CreateLeague(ctx context.Context, req CreateLeagueRequest) (league League, err error) {
+	if req.LeagueId == "" {
+		req.LeagueId = uuid.NewString()
+	}
+	ctx, span := tracing.Start(ctx, "CreateLeague", attribute.String("league_id", req.LeagueId))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	if req.MaxPlayers < 2 {
+		return league, fmt.Errorf("%w: maxPlayers must be at least 2", errInvalidLeague)
+	}
+	if !req.StartDate.After(time.Now()) {
+		return league, fmt.Errorf("%w: startDate must be in the future", errInvalidLeague)
+	}
+	if !req.EndDate.IsZero() && req.EndDate.Before(req.StartDate) {
+		return league, fmt.Errorf("%w: endDate is before startDate", errInvalidLeague)
+	}
+	path := utils.DraftPath(req.LeagueId)
+	err = path.Validate()
+	if err != nil {
+		return league, fmt.Errorf("%w: %v", errInvalidLeague, err)
+	}
+
+	league = League{
+		LeagueId:     req.LeagueId,
+		DisplayName:  req.DisplayName,
+		CurrentUsers: make([]LeagueUser, 0),
+		MaxPlayers:   req.MaxPlayers,
+		StartDate:    req.StartDate,
+		EndDate:      req.EndDate,
+		DraftType:    req.DraftType,
+		Level:        req.Level,
+	}
+	_, err = utils.Db.Doc(path).Create(ctx, league)
+	if status.Code(err) == codes.AlreadyExists {
+		return league, fmt.Errorf("%w: %s", errLeagueExists, req.LeagueId)
+	}
+	if err != nil {
+		return league, fmt.Errorf("error creating league %s: %v", req.LeagueId, err)
+	}
+
+	logging.FromContext(ctx).Info("created league", "league_id", league.LeagueId, "max_players", league.MaxPlayers)
+	return league, nil
+}
+
+// JoinLeague adds a user to a league in a transaction, so two users can not
+// both take the last spot, and locks the league once it is full
+func JoinLeague(ctx context.Context, leagueId string, user LeagueUser) (league League, err error) {
+	ctx, span := tracing.Start(ctx, "JoinLeague", attribute.String("league_id", leagueId))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	if user.OwnerId == "" || user.TokenId == "" {
+		return league, fmt.Errorf("%w: ownerId and tokenId are required", errInvalidLeague)
+	}
+
+	err = utils.Db.RunTransaction(ctx, utils.DraftsCollection, func(ctx context.Context, tx *firestore.Transaction) error {
+		league, err = utils.TxGet[League](tx, utils.Db, utils.DraftPath(leagueId))
+		if err != nil {
+			return err
+		}
+		switch {
+		case league.IsCancelled:
+			return errLeagueCancelled
+		case league.IsLocked || len(league.CurrentUsers) >= league.MaxPlayers:
+			return errLeagueFull
+		case !league.StartDate.IsZero() && time.Now().After(league.StartDate):
+			return errLeagueStarted
+		}
+		for _, existing := range league.CurrentUsers {
+			if ownerKey(existing.OwnerId) == ownerKey(user.OwnerId) {
+				return fmt.Errorf("%w: %s", errAlreadyJoined, user.OwnerId)
+			}
+			if existing.TokenId == user.TokenId {
+				return fmt.Errorf("%w: %s", errTokenInUse, user.TokenId)
+			}
+		}
+
+		league.CurrentUsers = append(league.CurrentUsers, user)
+		league.NumPlayers = len(league.CurrentUsers)
+		league.IsLocked = league.NumPlayers >= league.MaxPlayers
+		return tx.Update(utils.Db.Doc(utils.DraftPath(leagueId)), []firestore.Update{
+			{Path: "CurrentUsers", Value: league.CurrentUsers},
+			{Path: "NumPlayers", Value: league.NumPlayers},
+			{Path: "IsLocked", Value: league.IsLocked},
+		})
+	})
+	if err != nil {
+		return league, err
+	}
+
+	logging.FromContext(ctx).Info("owner joined league", "league_id", leagueId, "owner_id", user.OwnerId, "num_players", league.NumPlayers)
+	if league.IsLocked {
+		logging.FromContext(ctx).Info("league is full and locked", "league_id", leagueId)
+	}
+	return league, nil
+}
+
+// CancelLeague cancels a league that is not locked and records a pending
+// refund for each of its users in the same transaction
+func CancelLeague(ctx context.Context, leagueId string) (league League, refunds []Refund, err error) {
+	ctx, span := tracing.Start(ctx, "CancelLeague", attribute.String("league_id", leagueId))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	err = utils.Db.RunTransaction(ctx, utils.DraftsCollection, func(ctx context.Context, tx *firestore.Transaction) error {
+		league, err = utils.TxGet[League](tx, utils.Db, utils.DraftPath(leagueId))
+		if err != nil {
+			return err
+		}
+		if league.IsCancelled {
+			return errLeagueCancelled
+		}
+		if league.IsLocked {
+			return errLeagueFull
+		}
+
+		now := time.Now()
+		refunds = make([]Refund, 0, len(league.CurrentUsers))
+		for _, user := range league.CurrentUsers {
+			refund := Refund{
+				LeagueId:  leagueId,
+				OwnerId:   user.OwnerId,
+				TokenId:   user.TokenId,
+				Status:    RefundStatusPending,
+				CreatedAt: now,
+			}
+			err := utils.TxSet(tx, utils.Db, utils.RefundPath(leagueId, user.OwnerId), refund)
+			if err != nil {
+				return err
+			}
+			refunds = append(refunds, refund)
+		}
+
+		league.IsCancelled = true
+		return tx.Update(utils.Db.Doc(utils.DraftPath(leagueId)), []firestore.Update{
+			{Path: "IsCancelled", Value: true},
+		})
+	})
+	if err != nil {
+		return league, refunds, err
+	}
+
+	logging.FromContext(ctx).Info("cancelled league", "league_id", leagueId, "refunds", len(refunds))
+	return league, refunds, nil
+}
+
+type CancelLeaguesSummary struct {
+	DryRun           bool     `json:"dryRun"`
+	LeaguesChecked   int      `json:"leaguesChecked"`
+	LeaguesCancelled []string `json:"leaguesCancelled"`
+	Refunds          int      `json:"refunds"`
+	Failed           []string `json:"failed"`
+}
+
+// CancelUnfilledLeagues cancels every league that is still open after its
+// StartDate has passed. A dry run only lists the leagues it would cancel
+func CancelUnfilledLeagues(ctx context.Context, dryRun bool) (summary *CancelLeaguesSummary, err error) {
+	ctx, span := tracing.Start(ctx, "CancelUnfilledLeagues", attribute.Bool("dry_run", dryRun))
+	defer func() {
+		tracing.End(span, err)
+	}()
+	ctx = logging.WithRun(ctx, "cancel_unfilled_leagues")
+
+	summary = &CancelLeaguesSummary{
+		DryRun:           dryRun,
+		LeaguesCancelled: make([]string, 0),
+		Failed:           make([]string, 0),
+	}
+	now := time.Now()
+	query := utils.Db.Client.Collection(utils.DraftsCollection).Where("IsLocked", "==", false)
+	err = utils.Db.StreamDocuments(ctx, query, utils.PageSizeFromEnv(), func(snapshot *firestore.DocumentSnapshot) error {
+		var league League
+		err := snapshot.DataTo(&league)
+		if err != nil {
+			logging.FromContext(ctx).Error("error reading league", "document_id", snapshot.Ref.ID, "error", err)
+			summary.Failed = append(summary.Failed, snapshot.Ref.ID)
+			return nil
+		}
+		summary.LeaguesChecked++
+		if league.IsCancelled || league.StartDate.IsZero() || now.Before(league.StartDate) {
+			return nil
+		}
+
+		if dryRun {
+			summary.LeaguesCancelled = append(summary.LeaguesCancelled, snapshot.Ref.ID)
+			summary.Refunds += len(league.CurrentUsers)
+			return nil
+		}
+		_, refunds, err := CancelLeague(ctx, snapshot.Ref.ID)
+		if errors.Is(err, errLeagueFull) || errors.Is(err, errLeagueCancelled) {
+			// it filled up or was cancelled since the query read it
+			return nil
+		}
+		if err != nil {
+			logging.FromContext(ctx).Error("error cancelling league", "league_id", snapshot.Ref.ID, "error", err)
+			summary.Failed = append(summary.Failed, snapshot.Ref.ID)
+			return nil
+		}
+		summary.LeaguesCancelled = append(summary.LeaguesCancelled, snapshot.Ref.ID)
+		summary.Refunds += len(refunds)
+		return nil
+	})
+	if err != nil {
+		return summary, fmt.Errorf("error streaming open leagues: %v", err)
+	}
+
+	logging.FromContext(ctx).Info("finished cancelling unfilled leagues", "checked", summary.LeaguesChecked, "cancelled", len(summary.LeaguesCancelled), "failed", len(summary.Failed))
+	return summary, nil
+}
+
+// leagueErrorStatus maps a league lifecycle error to the response status
+func leagueErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errInvalidLeague):
+		return http.StatusBadRequest
+	case errors.Is(err, errLeagueExists), errors.Is(err, errLeagueFull), errors.Is(err, errLeagueCancelled),
+		errors.Is(err, errLeagueStarted), errors.Is(err, errAlreadyJoined), errors.Is(err, errTokenInUse):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func writeLeagueError(ctx context.Context, w http.ResponseWriter, err error) {
+	status := leagueErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		logging.FromContext(ctx).Error("league request failed", "error", err)
+	} else {
+		logging.FromContext(ctx).Info("league request rejected", "error", err)
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func CreateLeagueEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var reqData CreateLeagueRequest
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		http.Error(w, fmt.Sprint("Error decoding create league body: ", err), http.StatusBadRequest)
+		return
+	}
+
+	league, err := CreateLeague(ctx, reqData)
+	if err != nil {
+		writeLeagueError(ctx, w, err)
+		return
+	}
+	writeJSON(ctx, w, http.StatusCreated, league)
+}
+
+func GetLeagueEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	league, err := utils.Get[League](ctx, utils.Db, utils.DraftPath(chi.URLParam(r, "leagueId")))
+	if err != nil {
+		writeLeagueError(ctx, w, err)
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, league)
+}
+
+func JoinLeagueEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var user LeagueUser
+	err := json.NewDecoder(r.Body).Decode(&user)
+	if err != nil {
+		http.Error(w, fmt.Sprint("Error decoding join league body: ", err), http.StatusBadRequest)
+		return
+	}
+
+	league, err := JoinLeague(ctx, chi.URLParam(r, "leagueId"), user)
+	if err != nil {
+		writeLeagueError(ctx, w, err)
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, league)
+}
+
+func CancelLeagueEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	league, refunds, err := CancelLeague(ctx, chi.URLParam(r, "leagueId"))
+	if err != nil {
+		writeLeagueError(ctx, w, err)
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, map[string]any{"league": league, "refunds": refunds})
+}
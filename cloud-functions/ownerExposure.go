@@ -0,0 +1,260 @@
+package cloudfunctions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// PlayerExposure is how many of an owner's cards roster a player, next to how
+// often the player is drafted across every card
+type PlayerExposure struct {
+	PlayerId     string  `json:"playerId"`
+	Team         string  `json:"team"`
+	Position     string  `json:"position"`
+	Cards        int     `json:"cards"`
+	ExposurePct  float64 `json:"exposurePct"`
+	DraftRatePct float64 `json:"draftRatePct"`
+	// percentage points the owner is over, or under when negative, the field
+	DifferencePct float64 `json:"differencePct"`
+}
+
+// TeamStack is a quarterback rostered with receivers or tight ends of their own
+// team, such as BUF QB+WR
+type TeamStack struct {
+	Team        string   `json:"team"`
+	Positions   string   `json:"positions"`
+	Cards       int      `json:"cards"`
+	ExposurePct float64  `json:"exposurePct"`
+	CardIds     []string `json:"cardIds"`
+}
+
+type OwnerExposure struct {
+	OwnerId string           `json:"ownerId"`
+	Cards   int              `json:"cards"`
+	Players []PlayerExposure `json:"players"`
+	Stacks  []TeamStack      `json:"stacks"`
+}
+
+// stack is one team stacked on a card
+type stack struct {
+	Team      string
+	Positions string
+}
+
+// percent is part of total as a percentage rounded to two decimals
+func percent(part float64, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(part/total*10000) / 100
+}
+
+// rosterPlayers returns every player of a roster with the position they were
+// drafted at
+func rosterPlayers(roster *Roster) map[string][]RosterPlayer {
+	return map[string][]RosterPlayer{
+		"DST": roster.DST,
+		"QB":  roster.QB,
+		"RB":  roster.RB,
+		"TE":  roster.TE,
+		"WR":  roster.WR,
+	}
+}
+
+func rosterPlayerTeam(player RosterPlayer) string {
+	if player.Team != "" {
+		return player.Team
+	}
+	team, _ := splitPlayerId(player.PlayerId)
+	return team
+}
+
+// rosterStacks returns the teams whose QB is rostered with at least one of
+// their WRs or TEs, labelled by the positions stacked such as QB+WR+TE
+func rosterStacks(roster *Roster) []stack {
+	catchers := make(map[string]map[string]bool)
+	for position, players := range map[string][]RosterPlayer{"WR": roster.WR, "TE": roster.TE} {
+		for _, player := range players {
+			team := rosterPlayerTeam(player)
+			if catchers[team] == nil {
+				catchers[team] = make(map[string]bool)
+			}
+			catchers[team][position] = true
+		}
+	}
+
+	stacks := make([]stack, 0)
+	seen := make(map[string]bool)
+	for _, qb := range roster.QB {
+		team := rosterPlayerTeam(qb)
+		if seen[team] || len(catchers[team]) == 0 {
+			continue
+		}
+		seen[team] = true
+		positions := "QB"
+		for _, position := range []string{"WR", "TE"} {
+			if catchers[team][position] {
+				positions += "+" + position
+			}
+		}
+		stacks = append(stacks, stack{Team: team, Positions: positions})
+	}
+	return stacks
+}
+
+// loadDraftRates returns the share of cards each player is drafted on from
+// the stats map the ADP calculator writes, falling back to the one it reads
+func loadDraftRates(ctx context.Context) (map[string]float64, error) {
+	stats, err := utils.Get[StatsMap](ctx, utils.Db, utils.NewPlayerMapPath())
+	if errors.Is(err, utils.ErrNotFound) {
+		stats, err = utils.Get[StatsMap](ctx, utils.Db, utils.PlayerMapPath())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading player stats map: %v", err)
+	}
+	rates := make(map[string]float64, len(stats.Players))
+	for playerId, player := range stats.Players {
+		rates[playerId] = player.DraftRate
+	}
+	return rates, nil
+}
+
+// ownerTokens returns the draft tokens of an owner by OwnerKey, along with the
+// tokens written before OwnerKey existed that only match on OwnerId as given
+// or lowercased
+func ownerTokens(ctx context.Context, ownerId string) ([]DraftToken, error) {
+	collection := utils.Db.Client.Collection(utils.DraftTokensCollection)
+	tokens, err := utils.Query[DraftToken](ctx, utils.Db, collection.Where("OwnerKey", "==", ownerKey(ownerId)))
+	if err != nil {
+		return nil, err
+	}
+
+	ownerIds := []string{ownerId}
+	if ownerKey(ownerId) != ownerId {
+		ownerIds = append(ownerIds, ownerKey(ownerId))
+	}
+	legacy, err := utils.Query[DraftToken](ctx, utils.Db, collection.Where("OwnerId", "in", ownerIds))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		seen[token.CardId] = true
+	}
+	for _, token := range legacy {
+		if !seen[token.CardId] {
+			seen[token.CardId] = true
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+// GetOwnerExposure aggregates the rosters of every draft token an owner holds
+// into the share of their cards each player and team stack is on
+func GetOwnerExposure(ctx context.Context, ownerId string) (exposure *OwnerExposure, err error) {
+	ctx, span := tracing.Start(ctx, "GetOwnerExposure", attribute.String("owner_id", ownerId))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	exposure = &OwnerExposure{OwnerId: ownerId, Players: make([]PlayerExposure, 0), Stacks: make([]TeamStack, 0)}
+
+	tokens, err := ownerTokens(ctx, ownerId)
+	if err != nil {
+		return exposure, err
+	}
+	rates, err := loadDraftRates(ctx)
+	if err != nil {
+		return exposure, err
+	}
+
+	playerCards := make(map[string]int)
+	playerPositions := make(map[string]string)
+	playerTeams := make(map[string]string)
+	stackCards := make(map[stack][]string)
+	for _, token := range tokens {
+		if token.Roster == nil {
+			continue
+		}
+		exposure.Cards++
+
+		for position, players := range rosterPlayers(token.Roster) {
+			for _, player := range players {
+				playerCards[player.PlayerId]++
+				playerPositions[player.PlayerId] = position
+				playerTeams[player.PlayerId] = rosterPlayerTeam(player)
+			}
+		}
+		for _, s := range rosterStacks(token.Roster) {
+			stackCards[s] = append(stackCards[s], token.CardId)
+		}
+	}
+
+	cards := float64(exposure.Cards)
+	for playerId, count := range playerCards {
+		player := PlayerExposure{
+			PlayerId:     playerId,
+			Team:         playerTeams[playerId],
+			Position:     playerPositions[playerId],
+			Cards:        count,
+			ExposurePct:  percent(float64(count), cards),
+			DraftRatePct: percent(rates[playerId], 1),
+		}
+		player.DifferencePct = math.Round((player.ExposurePct-player.DraftRatePct)*100) / 100
+		exposure.Players = append(exposure.Players, player)
+	}
+	sort.Slice(exposure.Players, func(i, j int) bool {
+		if exposure.Players[i].Cards != exposure.Players[j].Cards {
+			return exposure.Players[i].Cards > exposure.Players[j].Cards
+		}
+		return exposure.Players[i].PlayerId < exposure.Players[j].PlayerId
+	})
+
+	for s, cardIds := range stackCards {
+		sort.Strings(cardIds)
+		exposure.Stacks = append(exposure.Stacks, TeamStack{
+			Team:        s.Team,
+			Positions:   s.Positions,
+			Cards:       len(cardIds),
+			ExposurePct: percent(float64(len(cardIds)), cards),
+			CardIds:     cardIds,
+		})
+	}
+	sort.Slice(exposure.Stacks, func(i, j int) bool {
+		if exposure.Stacks[i].Cards != exposure.Stacks[j].Cards {
+			return exposure.Stacks[i].Cards > exposure.Stacks[j].Cards
+		}
+		if exposure.Stacks[i].Team != exposure.Stacks[j].Team {
+			return exposure.Stacks[i].Team < exposure.Stacks[j].Team
+		}
+		return exposure.Stacks[i].Positions < exposure.Stacks[j].Positions
+	})
+
+	return exposure, nil
+}
+
+// OwnerExposureEndPoint serves the player and stack exposure of an owner's cards
+func OwnerExposureEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ownerId := chi.URLParam(r, "ownerId")
+
+	exposure, err := GetOwnerExposure(ctx, ownerId)
+	if err != nil {
+		logging.FromContext(ctx).Error("error reading owner exposure", "owner_id", ownerId, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, exposure)
+}
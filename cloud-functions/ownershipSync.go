@@ -0,0 +1,401 @@
+package cloudfunctions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/metrics"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// keccak256("Transfer(address,address,uint256)"), topic 0 of every ERC-721 transfer log
+const transferTopic = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+
+const (
+	defaultBlockRange    = 2000
+	defaultConfirmations = 12
+)
+
+// TransferEvent is one ERC-721 Transfer of a draft token
+type TransferEvent struct {
+	BlockNumber uint64 `json:"blockNumber"`
+	TxHash      string `json:"txHash"`
+	LogIndex    uint64 `json:"logIndex"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	TokenId     string `json:"tokenId"`
+}
+
+// TransferSource reads transfer events of the draft token contract, from a
+// node over json-rpc or from a fixture standing in for one
+type TransferSource interface {
+	LatestBlock(ctx context.Context) (uint64, error)
+	Transfers(ctx context.Context, fromBlock uint64, toBlock uint64) ([]TransferEvent, error)
+}
+
+// RPCTransferSource reads transfer logs with eth_getLogs
+type RPCTransferSource struct {
+	Url      string
+	Contract string
+	Client   *http.Client
+}
+
+type rpcRequest struct {
+	JsonRPC string `json:"jsonrpc"`
+	Id      int    `json:"id"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type rpcLog struct {
+	Topics      []string `json:"topics"`
+	BlockNumber string   `json:"blockNumber"`
+	TxHash      string   `json:"transactionHash"`
+	LogIndex    string   `json:"logIndex"`
+	Removed     bool     `json:"removed"`
+}
+
+func (s *RPCTransferSource) call(ctx context.Context, method string, params []any, result any) error {
+	body, err := json.Marshal(rpcRequest{JsonRPC: "2.0", Id: 1, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned http %d", method, res.StatusCode)
+	}
+
+	var rpcRes rpcResponse
+	err = json.NewDecoder(res.Body).Decode(&rpcRes)
+	if err != nil {
+		return fmt.Errorf("error decoding %s response: %v", method, err)
+	}
+	if rpcRes.Error != nil {
+		return fmt.Errorf("%s failed with %d: %s", method, rpcRes.Error.Code, rpcRes.Error.Message)
+	}
+	return json.Unmarshal(rpcRes.Result, result)
+}
+
+func parseHexUint(value string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 64)
+}
+
+// topicAddress reads the address held in the last 20 bytes of a 32 byte topic
+func topicAddress(topic string) string {
+	topic = strings.TrimPrefix(topic, "0x")
+	if len(topic) < 40 {
+		return ""
+	}
+	return "0x" + strings.ToLower(topic[len(topic)-40:])
+}
+
+func (s *RPCTransferSource) LatestBlock(ctx context.Context) (uint64, error) {
+	var result string
+	err := s.call(ctx, "eth_blockNumber", []any{}, &result)
+	if err != nil {
+		return 0, err
+	}
+	return parseHexUint(result)
+}
+
+func (s *RPCTransferSource) Transfers(ctx context.Context, fromBlock uint64, toBlock uint64) ([]TransferEvent, error) {
+	filter := map[string]any{
+		"address":   s.Contract,
+		"fromBlock": fmt.Sprintf("0x%x", fromBlock),
+		"toBlock":   fmt.Sprintf("0x%x", toBlock),
+		"topics":    []string{transferTopic},
+	}
+	var logs []rpcLog
+	err := s.call(ctx, "eth_getLogs", []any{filter}, &logs)
+	if err != nil {
+		return nil, err
+	}
+
+	transfers := make([]TransferEvent, 0, len(logs))
+	for _, log := range logs {
+		// erc-20 transfers share the topic but only index two arguments
+		if log.Removed || len(log.Topics) != 4 {
+			continue
+		}
+		blockNumber, err := parseHexUint(log.BlockNumber)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block number %q in transfer log: %v", log.BlockNumber, err)
+		}
+		logIndex, err := parseHexUint(log.LogIndex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log index %q in transfer log: %v", log.LogIndex, err)
+		}
+		tokenId, ok := new(big.Int).SetString(strings.TrimPrefix(log.Topics[3], "0x"), 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid token id %q in transfer log", log.Topics[3])
+		}
+		transfers = append(transfers, TransferEvent{
+			BlockNumber: blockNumber,
+			TxHash:      log.TxHash,
+			LogIndex:    logIndex,
+			From:        topicAddress(log.Topics[1]),
+			To:          topicAddress(log.Topics[2]),
+			TokenId:     tokenId.String(),
+		})
+	}
+	return transfers, nil
+}
+
+// FileTransferSource serves transfers from a json fixture, for running the
+// sync locally without a node
+type FileTransferSource struct {
+	Path string
+}
+
+type transferFixture struct {
+	LatestBlock uint64          `json:"latestBlock"`
+	Transfers   []TransferEvent `json:"transfers"`
+}
+
+func (s *FileTransferSource) read() (transferFixture, error) {
+	var fixture transferFixture
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return fixture, err
+	}
+	err = json.Unmarshal(data, &fixture)
+	if err != nil {
+		return fixture, fmt.Errorf("error decoding transfer fixture %s: %v", s.Path, err)
+	}
+	return fixture, nil
+}
+
+func (s *FileTransferSource) LatestBlock(ctx context.Context) (uint64, error) {
+	fixture, err := s.read()
+	return fixture.LatestBlock, err
+}
+
+func (s *FileTransferSource) Transfers(ctx context.Context, fromBlock uint64, toBlock uint64) ([]TransferEvent, error) {
+	fixture, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	transfers := make([]TransferEvent, 0)
+	for _, transfer := range fixture.Transfers {
+		if transfer.BlockNumber >= fromBlock && transfer.BlockNumber <= toBlock {
+			transfer.From = strings.ToLower(transfer.From)
+			transfer.To = strings.ToLower(transfer.To)
+			transfers = append(transfers, transfer)
+		}
+	}
+	return transfers, nil
+}
+
+// TransferSourceFromEnv returns the fixture in OWNERSHIP_FIXTURE when it is
+// set, and otherwise the node at OWNERSHIP_RPC_URL for OWNERSHIP_CONTRACT
+func TransferSourceFromEnv() (TransferSource, error) {
+	if path := os.Getenv("OWNERSHIP_FIXTURE"); path != "" {
+		return &FileTransferSource{Path: path}, nil
+	}
+	url, contract := os.Getenv("OWNERSHIP_RPC_URL"), os.Getenv("OWNERSHIP_CONTRACT")
+	if url == "" || contract == "" {
+		return nil, errors.New("OWNERSHIP_RPC_URL and OWNERSHIP_CONTRACT, or OWNERSHIP_FIXTURE, must be set to sync ownership")
+	}
+	return &RPCTransferSource{Url: url, Contract: contract, Client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// SyncCursor is the last block whose transfers have been applied
+type SyncCursor struct {
+	LastBlock uint64    `json:"lastBlock"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// TransferRecord is kept per transfer at draftTokens/{cardId}/transfers
+type TransferRecord struct {
+	TransferEvent
+	SyncedAt time.Time `json:"syncedAt"`
+}
+
+type OwnershipSyncSummary struct {
+	FromBlock       uint64 `json:"fromBlock"`
+	ToBlock         uint64 `json:"toBlock"`
+	Transfers       int    `json:"transfers"`
+	TokensUpdated   int    `json:"tokensUpdated"`
+	UnknownTokens   int    `json:"unknownTokens"`
+	CursorAdvanced  bool   `json:"cursorAdvanced"`
+	Cancelled       bool   `json:"cancelled,omitempty"`
+	RemainingBlocks uint64 `json:"remainingBlocks"`
+}
+
+func envUint(name string, fallback uint64) uint64 {
+	if value, err := strconv.ParseUint(os.Getenv(name), 10, 64); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// applyTransfers writes one block range of transfers: the history of every
+// transfer and the final owner of each token. Tokens this service has no
+// draft token for are counted and left alone
+func applyTransfers(ctx context.Context, transfers []TransferEvent, summary *OwnershipSyncSummary) error {
+	sort.Slice(transfers, func(i, j int) bool {
+		if transfers[i].BlockNumber != transfers[j].BlockNumber {
+			return transfers[i].BlockNumber < transfers[j].BlockNumber
+		}
+		return transfers[i].LogIndex < transfers[j].LogIndex
+	})
+
+	// the writer sends writes in parallel and takes one per document, so each token gets one owner write
+	finalOwner := make(map[string]string)
+	byToken := make(map[string][]TransferEvent)
+	for _, transfer := range transfers {
+		finalOwner[transfer.TokenId] = transfer.To
+		byToken[transfer.TokenId] = append(byToken[transfer.TokenId], transfer)
+	}
+
+	writer := utils.Db.NewBatchWriter(ctx, utils.BatchWriterOptionsFromEnv())
+	now := time.Now()
+	for tokenId, owner := range finalOwner {
+		token := utils.DraftTokenPath(tokenId)
+		_, err := utils.Get[DraftToken](ctx, utils.Db, token)
+		if errors.Is(err, utils.ErrNotFound) {
+			logging.FromContext(ctx).Debug("transfer of a token with no draft token", "card_id", tokenId)
+			summary.UnknownTokens++
+			continue
+		}
+		if err != nil {
+			writer.Close()
+			return err
+		}
+
+		for _, transfer := range byToken[tokenId] {
+			record := utils.TransferRecordPath(tokenId, transfer.TxHash, transfer.LogIndex)
+			writer.Set(record.Collection, record.DocumentId, TransferRecord{TransferEvent: transfer, SyncedAt: now})
+		}
+		writer.Set(token.Collection, token.DocumentId, map[string]any{"OwnerId": owner, "OwnerKey": ownerKey(owner)}, firestore.MergeAll)
+		summary.TokensUpdated++
+	}
+	return writer.Close()
+}
+
+// SyncOwnership applies the transfers since the checkpointed block to the
+// OwnerId of the draft tokens, a block range at a time. The cursor only moves
+// past a range once all of its writes are committed, so a failed or cancelled
+// run picks up where it stopped. Blocks newer than OWNERSHIP_CONFIRMATIONS
+// are left for a later run so reorgs do not leave stale owners behind. The
+// OwnerAddress of picks in a draft summary stays the owner who drafted them
+func SyncOwnership(ctx context.Context, source TransferSource) (summary *OwnershipSyncSummary, err error) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "SyncOwnership")
+	defer func() {
+		span.SetAttributes(attribute.Int("transfers", summary.Transfers))
+		metrics.ObserveJob("ownership_sync", start, err)
+		tracing.End(span, err)
+	}()
+	ctx = logging.WithRun(ctx, "ownership_sync")
+	summary = &OwnershipSyncSummary{}
+
+	var lock *utils.RunLock
+	ctx, lock, err = utils.Db.AcquireRunLock(ctx, "ownershipSync", utils.LockTTLFromEnv(), utils.LockWaitFromEnv())
+	if err != nil {
+		return summary, err
+	}
+	defer func() {
+		releaseErr := lock.Release(ctx)
+		if releaseErr != nil {
+			logging.FromContext(ctx).Warn("error releasing run lock", "error", releaseErr)
+		}
+	}()
+
+	cursorPath := utils.SyncCursorPath("ownership")
+	cursor, err := utils.Get[SyncCursor](ctx, utils.Db, cursorPath)
+	if errors.Is(err, utils.ErrNotFound) {
+		// the contract's deploy block, so the first run does not scan the whole chain
+		startBlock := envUint("OWNERSHIP_START_BLOCK", 1)
+		if startBlock > 0 {
+			cursor.LastBlock = startBlock - 1
+		}
+	} else if err != nil {
+		return summary, err
+	}
+
+	latest, err := source.LatestBlock(ctx)
+	if err != nil {
+		return summary, fmt.Errorf("error reading the latest block: %v", err)
+	}
+	confirmations := envUint("OWNERSHIP_CONFIRMATIONS", defaultConfirmations)
+	if latest < confirmations {
+		return summary, nil
+	}
+	safeBlock := latest - confirmations
+	blockRange := envUint("OWNERSHIP_BLOCK_RANGE", defaultBlockRange)
+
+	summary.FromBlock = cursor.LastBlock + 1
+	summary.ToBlock = cursor.LastBlock
+	for from := cursor.LastBlock + 1; from <= safeBlock; from += blockRange {
+		if ctx.Err() != nil {
+			summary.Cancelled = true
+			summary.RemainingBlocks = safeBlock - summary.ToBlock
+			return summary, ctx.Err()
+		}
+		to := from + blockRange - 1
+		if to > safeBlock {
+			to = safeBlock
+		}
+
+		transfers, err := source.Transfers(ctx, from, to)
+		if err != nil {
+			return summary, fmt.Errorf("error reading transfers of blocks %d to %d: %v", from, to, err)
+		}
+		err = applyTransfers(ctx, transfers, summary)
+		if err != nil {
+			return summary, fmt.Errorf("error applying transfers of blocks %d to %d: %v", from, to, err)
+		}
+		// empty ranges only move the cursor at the end, an interrupted run scans them again
+		if len(transfers) > 0 || to == safeBlock {
+			err = utils.Set(ctx, utils.Db, cursorPath, SyncCursor{LastBlock: to, UpdatedAt: time.Now()})
+			if err != nil {
+				return summary, fmt.Errorf("error saving the ownership sync cursor: %v", err)
+			}
+			summary.CursorAdvanced = true
+		}
+
+		summary.Transfers += len(transfers)
+		summary.ToBlock = to
+		logging.FromContext(ctx).Debug("applied transfers", "from_block", from, "to_block", to, "transfers", len(transfers))
+	}
+
+	logging.FromContext(ctx).Info("finished syncing ownership", "from_block", summary.FromBlock, "to_block", summary.ToBlock, "transfers", summary.Transfers, "tokens_updated", summary.TokensUpdated)
+	return summary, nil
+}
@@ -0,0 +1,78 @@
+package cloudfunctions
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ReadScoresCSV parses a weekly fantasy points export with a header row of
+// Team,DST,QB,RB,RB2,TE,WR,WR2 and an optional GameStatus column
+func ReadScoresCSV(r io.Reader) (Scores, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return Scores{}, fmt.Errorf("error reading scores csv header: %v", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToUpper(strings.TrimSpace(name))] = i
+	}
+
+	if _, ok := columns["TEAM"]; !ok {
+		return Scores{}, fmt.Errorf("scores csv is missing the Team column")
+	}
+
+	scores := Scores{
+		FantasyPoints: make([]Score, 0),
+	}
+
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return Scores{}, fmt.Errorf("error reading scores csv line %d: %v", line, err)
+		}
+
+		score := Score{
+			Team: record[columns["TEAM"]],
+		}
+		if i, ok := columns["GAMESTATUS"]; ok {
+			score.GameStatus = record[i]
+		}
+
+		points := map[string]*float64{
+			"DST": &score.DST,
+			"QB":  &score.QB,
+			"RB":  &score.RB,
+			"RB2": &score.RB2,
+			"TE":  &score.TE,
+			"WR":  &score.WR,
+			"WR2": &score.WR2,
+		}
+		for column, field := range points {
+			i, ok := columns[column]
+			if !ok || strings.TrimSpace(record[i]) == "" {
+				continue
+			}
+			value, err := strconv.ParseFloat(strings.TrimSpace(record[i]), 64)
+			if err != nil {
+				return Scores{}, fmt.Errorf("invalid %s value %q for %s on line %d", column, record[i], score.Team, line)
+			}
+			*field = value
+		}
+
+		scores.FantasyPoints = append(scores.FantasyPoints, score)
+	}
+
+	return scores, nil
+}
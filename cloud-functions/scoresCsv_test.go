@@ -0,0 +1,73 @@
+package cloudfunctions
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadScoresCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		want    []Score
+		wantErr bool
+	}{
+		{
+			name: "valid rows",
+			csv:  "Team,DST,QB,RB,RB2,TE,WR,WR2,GameStatus\nBUF,8,24.5,12,6.2,9,18,11.4,Final\n",
+			want: []Score{{Team: "BUF", DST: 8, QB: 24.5, RB: 12, RB2: 6.2, TE: 9, WR: 18, WR2: 11.4, GameStatus: "Final"}},
+		},
+		{
+			name: "header casing and blank values",
+			csv:  " team, qb ,WR\nMIA,,15\n",
+			want: []Score{{Team: "MIA", WR: 15}},
+		},
+		{
+			name: "header only",
+			csv:  "Team,QB\n",
+			want: []Score{},
+		},
+		{
+			name:    "empty file",
+			csv:     "",
+			wantErr: true,
+		},
+		{
+			name:    "missing team column",
+			csv:     "QB,WR\n20,10\n",
+			wantErr: true,
+		},
+		{
+			name:    "row with too few fields",
+			csv:     "Team,QB,WR\nBUF,20,10\nMIA,12\n",
+			wantErr: true,
+		},
+		{
+			name:    "row with too many fields",
+			csv:     "Team,QB\nBUF,20,10\n",
+			wantErr: true,
+		},
+		{
+			name:    "non numeric points",
+			csv:     "Team,QB\nBUF,twenty\n",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated quote",
+			csv:     "Team,QB\n\"BUF,20\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadScoresCSV(strings.NewReader(tt.csv))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadScoresCSV() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got.FantasyPoints, tt.want) {
+				t.Errorf("ReadScoresCSV() = %+v, want %+v", got.FantasyPoints, tt.want)
+			}
+		})
+	}
+}
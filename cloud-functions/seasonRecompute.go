@@ -0,0 +1,191 @@
+package cloudfunctions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/metrics"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// GameweekIds returns the gameweek document ids from week 1 through the given week
+func GameweekIds(throughWeek int) []string {
+	weeks := make([]string, 0, throughWeek)
+	for i := 1; i <= throughWeek; i++ {
+		weeks = append(weeks, strconv.Itoa(i))
+	}
+	return weeks
+}
+
+// recomputeCardSeason walks the weekly card scores of a token in order and
+// rebuilds every season total from the stored ScoreWeek values so a correction
+// to an early week carries through to the rest of the season. The totals of
+// the last week are added to standings for the token
+func recomputeCardSeason(ctx context.Context, token *DraftToken, gameweeks []string, writer *utils.BatchWriter, standings *tokenStandings) (err error) {
+	ctx, span := tracing.Start(ctx, "recomputeCardSeason", attribute.String("card_id", token.CardId))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	prev, err := seedPrevWeek(ctx, token, gameweeks)
+	if err != nil {
+		return err
+	}
+	for _, gameweek := range gameweeks {
+		path := utils.CardScoresPath(token.LeagueId, gameweek, token.CardId)
+		cardScores, err := utils.Get[CardScores](ctx, utils.Db, path)
+		if err != nil {
+			return err
+		}
+
+		carryPrevWeekSeason(&cardScores, prev)
+		cardScores, err = totalCardScores(cardScores)
+		if err != nil {
+			return fmt.Errorf("gameweek %s: %w", gameweek, err)
+		}
+
+		writer.Set(path.Collection, path.DocumentId, cardScores)
+		prev = &cardScores
+	}
+	if prev != nil && len(gameweeks) > 0 {
+		standings.add(token, gameweeks[len(gameweeks)-1], *prev)
+	}
+
+	return nil
+}
+
+// seedPrevWeek returns the card scores of the week before the first of
+// gameweeks, so recomputing from a later week carries the season totals of
+// the weeks before it. Nil is returned when the first week starts the season
+// or the card has no card scores for the week before
+func seedPrevWeek(ctx context.Context, token *DraftToken, gameweeks []string) (*CardScores, error) {
+	if len(gameweeks) == 0 {
+		return nil, nil
+	}
+	week, err := strconv.Atoi(gameweeks[0])
+	if err != nil || week <= 1 {
+		return nil, nil
+	}
+	prev, err := utils.Get[CardScores](ctx, utils.Db, utils.CardScoresPath(token.LeagueId, strconv.Itoa(week-1), token.CardId))
+	if errors.Is(err, utils.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &prev, nil
+}
+
+// carryPrevWeekSeason sets the previous week season values of a card from the
+// card of the week before, or zeroes them when this is the first week
+func carryPrevWeekSeason(cardScores *CardScores, prev *CardScores) {
+	prevContribution := make(map[string]float64)
+	if prev != nil {
+		for _, players := range [][]ScoreObject{prev.Roster.DST, prev.Roster.QB, prev.Roster.RB, prev.Roster.TE, prev.Roster.WR} {
+			for _, player := range players {
+				prevContribution[player.PlayerId] = player.ScoreSeason
+			}
+		}
+		cardScores.PrevWeekSeasonScore = prev.ScoreSeason
+	} else {
+		cardScores.PrevWeekSeasonScore = 0
+	}
+
+	for _, players := range [][]ScoreObject{cardScores.Roster.DST, cardScores.Roster.QB, cardScores.Roster.RB, cardScores.Roster.TE, cardScores.Roster.WR} {
+		for i := range players {
+			players[i].PrevWeekSeasonContribution = prevContribution[players[i].PlayerId]
+		}
+	}
+}
+
+type RecomputeSummary struct {
+	GameWeeks       []string `json:"gameWeeks"`
+	CardsRecomputed int      `json:"cardsRecomputed"`
+	CardsSkipped    int      `json:"cardsSkipped"`
+	// cards left with the season totals they had before
+	CardsFailed int `json:"cardsFailed"`
+}
+
+// RecomputeSeason rebuilds the season totals of every rostered draft token
+// across the given gameweeks, which must be in season order. It holds the
+// scoring lock of every gameweek it rewrites
+func RecomputeSeason(ctx context.Context, gameweeks []string) (summary *RecomputeSummary, err error) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "RecomputeSeason", attribute.Int("gameweeks", len(gameweeks)))
+	defer func() {
+		metrics.ObserveJob("recompute_season", start, err)
+		tracing.End(span, err)
+	}()
+	ctx = logging.WithRun(ctx, "recompute_season")
+	summary = &RecomputeSummary{GameWeeks: gameweeks}
+
+	// every week is rewritten, so each one is held against scoring and rollover
+	locks := make([]*utils.RunLock, 0, len(gameweeks))
+	defer func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			releaseErr := locks[i].Release(ctx)
+			if releaseErr != nil {
+				logging.FromContext(ctx).Warn("error releasing run lock", "error", releaseErr)
+			}
+		}
+	}()
+	for _, gameweek := range gameweeks {
+		var lock *utils.RunLock
+		ctx, lock, err = utils.Db.AcquireRunLock(ctx, scoringLockKey(gameweek), utils.LockTTLFromEnv(), utils.LockWaitFromEnv())
+		if err != nil {
+			return summary, err
+		}
+		locks = append(locks, lock)
+	}
+
+	writer := utils.Db.NewBatchWriter(ctx, utils.BatchWriterOptionsFromEnv())
+
+	var recomputed, skipped, failed atomic.Int64
+	standings := &tokenStandings{}
+	err = utils.Db.ForEachDocument(ctx, utils.Db.Client.Collection(utils.DraftTokensCollection).Query, utils.PageSizeFromEnv(), utils.WorkersFromEnv(), func(snapshot *firestore.DocumentSnapshot) error {
+		var token DraftToken
+		err := snapshot.DataTo(&token)
+		if err != nil {
+			logging.FromContext(ctx).Error("error reading snapshot into draft token", "document_id", snapshot.Ref.ID, "error", err)
+			return err
+		}
+		if token.Roster == nil || len(token.Roster.DST) == 0 {
+			logging.FromContext(ctx).Debug("card does not have a roster yet, skipping it", "card_id", token.CardId)
+			skipped.Add(1)
+			return nil
+		}
+		err = recomputeCardSeason(ctx, &token, gameweeks, writer, standings)
+		if err != nil {
+			logging.FromContext(ctx).Error("error recomputing season for card", "card_id", token.CardId, "error", err)
+			failed.Add(1)
+			return nil
+		}
+		logging.FromContext(ctx).Debug("finished recomputing season for card", "card_id", token.CardId)
+		recomputed.Add(1)
+		return nil
+	})
+	if err == nil {
+		standings.write(writer)
+	}
+	closeErr := writer.Close()
+	summary.CardsRecomputed = int(recomputed.Load())
+	summary.CardsSkipped = int(skipped.Load())
+	summary.CardsFailed = int(failed.Load())
+	if err != nil {
+		return summary, err
+	}
+	if closeErr != nil {
+		return summary, closeErr
+	}
+	logging.FromContext(ctx).Info("finished recomputing the season for all draft tokens", "gameweeks", len(gameweeks), "recomputed", summary.CardsRecomputed, "skipped", summary.CardsSkipped, "failed", summary.CardsFailed)
+
+	return summary, nil
+}
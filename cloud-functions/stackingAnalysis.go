@@ -0,0 +1,294 @@
+package cloudfunctions
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/metrics"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// TeamStackStats is how the cards stacking one team scored against the cards
+// with no stack at all
+type TeamStackStats struct {
+	Team              string  `json:"team"`
+	StackedCards      int     `json:"stackedCards"`
+	StackFrequencyPct float64 `json:"stackFrequencyPct"`
+	AvgPoints         float64 `json:"avgPoints"`
+	// points the stacked players scored together on an average card
+	AvgStackPoints float64 `json:"avgStackPoints"`
+	// average points over the cards with no stack in the same week
+	LiftPoints float64 `json:"liftPoints"`
+}
+
+type WeekStackAnalysis struct {
+	GameWeek           string           `json:"gameWeek"`
+	ScoredCards        int              `json:"scoredCards"`
+	StackedCards       int              `json:"stackedCards"`
+	StackFrequencyPct  float64          `json:"stackFrequencyPct"`
+	AvgStackedPoints   float64          `json:"avgStackedPoints"`
+	AvgUnstackedPoints float64          `json:"avgUnstackedPoints"`
+	LiftPoints         float64          `json:"liftPoints"`
+	Teams              []TeamStackStats `json:"teams"`
+}
+
+// StackingAnalysis is published to analytics/stacking. Teams covers every
+// week, where lift is measured against the unstacked cards of each card's own week
+type StackingAnalysis struct {
+	DryRun      bool                `json:"dryRun"`
+	CardsRead   int                 `json:"cardsRead"`
+	Weeks       []WeekStackAnalysis `json:"weeks"`
+	Teams       []TeamStackStats    `json:"teams"`
+	GeneratedAt time.Time           `json:"generatedAt"`
+}
+
+type teamStackTotals struct {
+	cards       int
+	points      float64
+	stackPoints float64
+}
+
+type weekStackTotals struct {
+	scored          int
+	stacked         int
+	stackedPoints   float64
+	unstackedPoints float64
+	teams           map[string]*teamStackTotals
+}
+
+func round2(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+// scoreRosterToRoster keeps the team and player of each scored player so the
+// stacks of a card can be found the same way as on a draft token
+func scoreRosterToRoster(roster ScoreRoster) *Roster {
+	toPlayers := func(objects []ScoreObject) []RosterPlayer {
+		players := make([]RosterPlayer, 0, len(objects))
+		for _, object := range objects {
+			players = append(players, RosterPlayer{Team: object.Team, PlayerId: object.PlayerId})
+		}
+		return players
+	}
+	return &Roster{
+		DST: toPlayers(roster.DST),
+		QB:  toPlayers(roster.QB),
+		RB:  toPlayers(roster.RB),
+		TE:  toPlayers(roster.TE),
+		WR:  toPlayers(roster.WR),
+	}
+}
+
+// stackPoints is what the QB, WRs and TEs of a team scored on a card in the week
+func stackPoints(roster ScoreRoster, team string) float64 {
+	points := 0.0
+	for _, players := range [][]ScoreObject{roster.QB, roster.WR, roster.TE} {
+		for _, player := range players {
+			playerTeam := player.Team
+			if playerTeam == "" {
+				playerTeam, _ = splitPlayerId(player.PlayerId)
+			}
+			if playerTeam == team {
+				points += player.ScoreWeek
+			}
+		}
+	}
+	return points
+}
+
+// cardScoresGameweek returns the gameweek of a card scores document from its
+// path, drafts/{leagueId}/scores/{gameweek}/cards/{cardId}
+func cardScoresGameweek(ref *firestore.DocumentRef) (string, bool) {
+	week := ref.Parent.Parent
+	if week == nil || week.Parent == nil || week.Parent.ID != "scores" {
+		return "", false
+	}
+	return week.ID, true
+}
+
+// addCard counts one scored card of a week
+func (w *weekStackTotals) addCard(cardScores CardScores) {
+	w.scored++
+	stacks := rosterStacks(scoreRosterToRoster(cardScores.Roster))
+	if len(stacks) == 0 {
+		w.unstackedPoints += cardScores.ScoreWeek
+		return
+	}
+
+	w.stacked++
+	w.stackedPoints += cardScores.ScoreWeek
+	for _, s := range stacks {
+		team, ok := w.teams[s.Team]
+		if !ok {
+			team = &teamStackTotals{}
+			w.teams[s.Team] = team
+		}
+		team.cards++
+		team.points += cardScores.ScoreWeek
+		team.stackPoints += stackPoints(cardScores.Roster, s.Team)
+	}
+}
+
+func (w *weekStackTotals) unstackedAverage() float64 {
+	if unstacked := w.scored - w.stacked; unstacked > 0 {
+		return w.unstackedPoints / float64(unstacked)
+	}
+	return 0
+}
+
+func sortTeamStackStats(teams []TeamStackStats) {
+	sort.Slice(teams, func(i, j int) bool {
+		if teams[i].StackedCards != teams[j].StackedCards {
+			return teams[i].StackedCards > teams[j].StackedCards
+		}
+		return teams[i].Team < teams[j].Team
+	})
+}
+
+// summarizeStacking turns the weekly totals into the published analysis
+func summarizeStacking(weeks map[string]*weekStackTotals, analysis *StackingAnalysis) {
+	gameweeks := make([]string, 0, len(weeks))
+	for gameweek := range weeks {
+		gameweeks = append(gameweeks, gameweek)
+	}
+	sort.Slice(gameweeks, func(i, j int) bool {
+		a, errA := strconv.Atoi(gameweeks[i])
+		b, errB := strconv.Atoi(gameweeks[j])
+		if errA != nil || errB != nil {
+			return gameweeks[i] < gameweeks[j]
+		}
+		return a < b
+	})
+
+	seasonTeams := make(map[string]*teamStackTotals)
+	seasonLift := make(map[string]float64)
+	scoredCards := 0
+	for _, gameweek := range gameweeks {
+		totals := weeks[gameweek]
+		scoredCards += totals.scored
+		unstackedAvg := totals.unstackedAverage()
+
+		week := WeekStackAnalysis{
+			GameWeek:           gameweek,
+			ScoredCards:        totals.scored,
+			StackedCards:       totals.stacked,
+			StackFrequencyPct:  percent(float64(totals.stacked), float64(totals.scored)),
+			AvgUnstackedPoints: round2(unstackedAvg),
+			Teams:              make([]TeamStackStats, 0, len(totals.teams)),
+		}
+		if totals.stacked > 0 {
+			week.AvgStackedPoints = round2(totals.stackedPoints / float64(totals.stacked))
+			week.LiftPoints = round2(totals.stackedPoints/float64(totals.stacked) - unstackedAvg)
+		}
+
+		for name, team := range totals.teams {
+			avg := team.points / float64(team.cards)
+			week.Teams = append(week.Teams, TeamStackStats{
+				Team:              name,
+				StackedCards:      team.cards,
+				StackFrequencyPct: percent(float64(team.cards), float64(totals.scored)),
+				AvgPoints:         round2(avg),
+				AvgStackPoints:    round2(team.stackPoints / float64(team.cards)),
+				LiftPoints:        round2(avg - unstackedAvg),
+			})
+
+			season, ok := seasonTeams[name]
+			if !ok {
+				season = &teamStackTotals{}
+				seasonTeams[name] = season
+			}
+			season.cards += team.cards
+			season.points += team.points
+			season.stackPoints += team.stackPoints
+			seasonLift[name] += team.points - float64(team.cards)*unstackedAvg
+		}
+		sortTeamStackStats(week.Teams)
+		analysis.Weeks = append(analysis.Weeks, week)
+	}
+
+	for name, team := range seasonTeams {
+		analysis.Teams = append(analysis.Teams, TeamStackStats{
+			Team:              name,
+			StackedCards:      team.cards,
+			StackFrequencyPct: percent(float64(team.cards), float64(scoredCards)),
+			AvgPoints:         round2(team.points / float64(team.cards)),
+			AvgStackPoints:    round2(team.stackPoints / float64(team.cards)),
+			LiftPoints:        round2(seasonLift[name] / float64(team.cards)),
+		})
+	}
+	sortTeamStackStats(analysis.Teams)
+}
+
+// AnalyzeStacking reads the card scores of every league and week and measures
+// how cards stacking a QB with a WR or TE of the same team scored against
+// cards with no stack. Cards the scorer has not marked scored for a week are
+// left out. The analysis is written to analytics/stacking unless
+// dryRun is set
+func AnalyzeStacking(ctx context.Context, dryRun bool) (analysis *StackingAnalysis, err error) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "AnalyzeStacking", attribute.Bool("dry_run", dryRun))
+	defer func() {
+		span.SetAttributes(attribute.Int("cards", analysis.CardsRead))
+		metrics.ObserveJob("stacking_analysis", start, err)
+		tracing.End(span, err)
+	}()
+	ctx = logging.WithRun(ctx, "stacking_analysis")
+
+	analysis = &StackingAnalysis{
+		DryRun:      dryRun,
+		Weeks:       make([]WeekStackAnalysis, 0),
+		Teams:       make([]TeamStackStats, 0),
+		GeneratedAt: time.Now(),
+	}
+
+	weeks := make(map[string]*weekStackTotals)
+	err = utils.Db.StreamDocuments(ctx, utils.Db.Client.CollectionGroup("cards").Query, utils.PageSizeFromEnv(), func(snapshot *firestore.DocumentSnapshot) error {
+		gameweek, ok := cardScoresGameweek(snapshot.Ref)
+		if !ok {
+			return nil
+		}
+		var cardScores CardScores
+		err := snapshot.DataTo(&cardScores)
+		if err != nil {
+			logging.FromContext(ctx).Warn("error reading snapshot into card scores", "path", snapshot.Ref.Path, "error", err)
+			return nil
+		}
+		analysis.CardsRead++
+		// cards scored before the flag was written only show it by their points
+		if !cardScores.Scored && cardScores.ScoreWeek == 0 {
+			return nil
+		}
+
+		week, ok := weeks[gameweek]
+		if !ok {
+			week = &weekStackTotals{teams: make(map[string]*teamStackTotals)}
+			weeks[gameweek] = week
+		}
+		week.addCard(cardScores)
+		return nil
+	})
+	if err != nil {
+		return analysis, err
+	}
+
+	summarizeStacking(weeks, analysis)
+
+	if dryRun {
+		logging.FromContext(ctx).Info("dry run so the stacking analysis is not published", "weeks", len(analysis.Weeks))
+		return analysis, nil
+	}
+	err = utils.Set(ctx, utils.Db, utils.StackingAnalysisPath(), analysis)
+	if err != nil {
+		return analysis, err
+	}
+
+	logging.FromContext(ctx).Info("published stacking analysis", "cards", analysis.CardsRead, "weeks", len(analysis.Weeks), "teams", len(analysis.Teams))
+	return analysis, nil
+}
@@ -0,0 +1,116 @@
+package cloudfunctions
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"github.com/go-chi/chi"
+)
+
+// MetadataAttribute is one trait of the OpenSea metadata standard. Numeric
+// traits set DisplayType so marketplaces show them as numbers
+type MetadataAttribute struct {
+	DisplayType string `json:"display_type,omitempty"`
+	TraitType   string `json:"trait_type"`
+	Value       any    `json:"value"`
+}
+
+// TokenMetadata is the ERC-721 metadata json of a draft token
+type TokenMetadata struct {
+	Name        string              `json:"name"`
+	Description string              `json:"description"`
+	Image       string              `json:"image"`
+	Attributes  []MetadataAttribute `json:"attributes"`
+}
+
+// numberOrString returns value as a number when it holds one so it can be
+// used as a numeric trait
+func numberOrString(value string) any {
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		return number
+	}
+	return value
+}
+
+// BuildTokenMetadata builds the metadata of a draft token from what is stored
+// on it, with one attribute per rostered team position
+func BuildTokenMetadata(token DraftToken) TokenMetadata {
+	metadata := TokenMetadata{
+		Name:        fmt.Sprintf("Draft Token #%s", token.CardId),
+		Description: "A best ball draft token",
+		Image:       cardImageUrl(token),
+		Attributes:  make([]MetadataAttribute, 0),
+	}
+	if token.LeagueDisplayName != "" {
+		metadata.Description = fmt.Sprintf("A best ball draft token drafted in %s", token.LeagueDisplayName)
+	}
+
+	if token.Roster != nil {
+		for _, group := range []struct {
+			position string
+			players  []RosterPlayer
+		}{
+			{"DST", token.Roster.DST},
+			{"QB", token.Roster.QB},
+			{"RB", token.Roster.RB},
+			{"TE", token.Roster.TE},
+			{"WR", token.Roster.WR},
+		} {
+			for _, player := range group.players {
+				metadata.Attributes = append(metadata.Attributes, MetadataAttribute{TraitType: group.position, Value: player.PlayerId})
+			}
+		}
+	}
+
+	if token.Level != "" {
+		metadata.Attributes = append(metadata.Attributes, MetadataAttribute{TraitType: "Level", Value: token.Level})
+	}
+	if token.LeagueDisplayName != "" {
+		metadata.Attributes = append(metadata.Attributes, MetadataAttribute{TraitType: "League", Value: token.LeagueDisplayName})
+	}
+	if token.Rank != "" {
+		rank := MetadataAttribute{TraitType: "Rank", Value: numberOrString(token.Rank)}
+		if _, ok := rank.Value.(float64); ok {
+			rank.DisplayType = "number"
+		}
+		metadata.Attributes = append(metadata.Attributes, rank)
+	}
+	if token.SeasonScore != "" {
+		score := MetadataAttribute{TraitType: "Season Score", Value: numberOrString(token.SeasonScore)}
+		if _, ok := score.Value.(float64); ok {
+			score.DisplayType = "number"
+		}
+		metadata.Attributes = append(metadata.Attributes, score)
+	}
+
+	return metadata
+}
+
+// TokenMetadataEndPoint serves the metadata of a draft token. It is read from
+// the token on every request, which scoring keeps up to date, and only cached
+// briefly so marketplaces see new scores soon after a week is scored
+func TokenMetadataEndPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cardId := chi.URLParam(r, "cardId")
+
+	token, err := utils.Get[DraftToken](ctx, utils.Db, utils.DraftTokenPath(cardId))
+	if errors.Is(err, utils.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("draft token %s not found", cardId), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("error reading draft token for metadata", "card_id", cardId, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if token.CardId == "" {
+		token.CardId = cardId
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	writeJSON(ctx, w, http.StatusOK, BuildTokenMetadata(token))
+}
@@ -0,0 +1,161 @@
+package cloudfunctions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/metrics"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type RolloverSummary struct {
+	GameWeek     string `json:"gameWeek"`
+	PrevGameWeek string `json:"prevGameWeek"`
+	DryRun       bool   `json:"dryRun"`
+	CardsCreated int    `json:"cardsCreated"`
+	// cards that already had card scores for the week, which are left alone
+	CardsExisting int `json:"cardsExisting"`
+	// cards with no card scores the week before, such as ones drafted late
+	CardsWithoutPrev int `json:"cardsWithoutPrev"`
+	CardsFailed      int `json:"cardsFailed"`
+	lock             sync.Mutex
+}
+
+func (s *RolloverSummary) record(counter *int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	*counter++
+}
+
+// rolloverCardScores starts the card scores of a new week from the week
+// before: nothing is scored yet, every season total carries over and becomes
+// the previous week season value the new week is added to
+func rolloverCardScores(prev CardScores) CardScores {
+	next := CardScores{
+		CardId: prev.CardId,
+		Roster: ScoreRoster{
+			DST: append([]ScoreObject(nil), prev.Roster.DST...),
+			QB:  append([]ScoreObject(nil), prev.Roster.QB...),
+			RB:  append([]ScoreObject(nil), prev.Roster.RB...),
+			TE:  append([]ScoreObject(nil), prev.Roster.TE...),
+			WR:  append([]ScoreObject(nil), prev.Roster.WR...),
+		},
+	}
+	carryPrevWeekSeason(&next, &prev)
+
+	next.ScoreSeason = next.PrevWeekSeasonScore
+	for _, players := range [][]ScoreObject{next.Roster.DST, next.Roster.QB, next.Roster.RB, next.Roster.TE, next.Roster.WR} {
+		for i := range players {
+			players[i].ScoreWeek = 0
+			players[i].ScoreSeason = players[i].PrevWeekSeasonContribution
+			players[i].IsUsedInCardScore = false
+		}
+	}
+	return next
+}
+
+func rolloverCard(ctx context.Context, token *DraftToken, gameweek string, prevGameweek string, summary *RolloverSummary, writer *utils.BatchWriter) (err error) {
+	ctx, span := tracing.Start(ctx, "rolloverCard", attribute.String("card_id", token.CardId))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	path := utils.CardScoresPath(token.LeagueId, gameweek, token.CardId)
+	_, err = utils.Get[CardScores](ctx, utils.Db, path)
+	if err == nil {
+		summary.record(&summary.CardsExisting)
+		return nil
+	}
+	if !errors.Is(err, utils.ErrNotFound) {
+		return err
+	}
+
+	prev, err := utils.Get[CardScores](ctx, utils.Db, utils.CardScoresPath(token.LeagueId, prevGameweek, token.CardId))
+	if errors.Is(err, utils.ErrNotFound) {
+		logging.FromContext(ctx).Warn("card has no card scores for the previous week", "card_id", token.CardId, "gameweek", prevGameweek)
+		summary.record(&summary.CardsWithoutPrev)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	next := rolloverCardScores(prev)
+	if !summary.DryRun {
+		writer.Set(path.Collection, path.DocumentId, next)
+	}
+	summary.record(&summary.CardsCreated)
+	return nil
+}
+
+// RolloverWeek creates the card scores of every rostered card for gameweek
+// from its card scores of the week before, so ScoreDraftTokens finds every
+// card ready to score. Cards that already have the week are left as they are
+func RolloverWeek(ctx context.Context, gameweek string, dryRun bool) (summary *RolloverSummary, err error) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "RolloverWeek", attribute.String("gameweek", gameweek), attribute.Bool("dry_run", dryRun))
+	defer func() {
+		metrics.ObserveJob("rollover_week", start, err)
+		tracing.End(span, err)
+	}()
+	ctx = logging.WithRun(ctx, "rollover_week")
+
+	summary = &RolloverSummary{GameWeek: gameweek, DryRun: dryRun}
+	week, err := strconv.Atoi(gameweek)
+	if err != nil || week < 2 {
+		return summary, fmt.Errorf("%w: gameweek %q has no week before it to roll over from", errInvalidJob, gameweek)
+	}
+	summary.PrevGameWeek = strconv.Itoa(week - 1)
+
+	// the week's card scores are the documents scoring writes, so the two share a lock
+	if !dryRun {
+		var lock *utils.RunLock
+		ctx, lock, err = utils.Db.AcquireRunLock(ctx, scoringLockKey(gameweek), utils.LockTTLFromEnv(), utils.LockWaitFromEnv())
+		if err != nil {
+			return summary, err
+		}
+		defer func() {
+			releaseErr := lock.Release(ctx)
+			if releaseErr != nil {
+				logging.FromContext(ctx).Warn("error releasing run lock", "error", releaseErr)
+			}
+		}()
+	}
+
+	writer := utils.Db.NewBatchWriter(ctx, utils.BatchWriterOptionsFromEnv())
+	err = utils.Db.ForEachDocument(ctx, utils.Db.Client.Collection(utils.DraftTokensCollection).Query, utils.PageSizeFromEnv(), utils.WorkersFromEnv(), func(snapshot *firestore.DocumentSnapshot) error {
+		var token DraftToken
+		err := snapshot.DataTo(&token)
+		if err != nil {
+			logging.FromContext(ctx).Error("error reading snapshot into draft token", "document_id", snapshot.Ref.ID, "error", err)
+			return err
+		}
+		if token.Roster == nil || len(token.Roster.DST) == 0 {
+			return nil
+		}
+		err = rolloverCard(ctx, &token, gameweek, summary.PrevGameWeek, summary, writer)
+		if err != nil && ctx.Err() == nil {
+			logging.FromContext(ctx).Error("error rolling over card", "card_id", token.CardId, "error", err)
+			summary.record(&summary.CardsFailed)
+		}
+		return nil
+	})
+	closeErr := writer.Close()
+	if err != nil {
+		return summary, err
+	}
+	if closeErr != nil {
+		return summary, closeErr
+	}
+
+	logging.FromContext(ctx).Info("finished rolling over card scores", "gameweek", gameweek, "created", summary.CardsCreated, "existing", summary.CardsExisting, "without_prev", summary.CardsWithoutPrev, "failed", summary.CardsFailed)
+	return summary, nil
+}
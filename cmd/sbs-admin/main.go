@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	cloudfunctions "github.com/CJPotter10/sbs-cloud-functions-api/cloud-functions"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+	"github.com/google/uuid"
+)
+
+const usage = `usage: sbs-admin <command> [flags]
+
+commands:
+  adp compute [--dry-run]                      recalculate player ADP from all locked leagues
+  score week --week <n> --input <scores.csv>   score every draft token for a gameweek (--dry-run to preview)
+  rollover week --week <n> [--dry-run]         create a gameweek's card scores from the week before
+  ownership sync [--fixture <transfers.json>]  apply draft token transfers since the last synced block
+  analyze stacks [--dry-run]                   measure how same team QB stacks scored against unstacked cards
+  recompute season --through <n>               rebuild season totals from the weekly card scores
+  export league <leagueId> [--week <n>]        print a league, its draft and its tokens as json
+  validate                                     report leagues and tokens that can not be processed
+  pubsub push [--url <url>] (--file <envelope.json> | --job <job> [--week <n>] [--input <scores.csv>])
+                                               post a pub/sub push envelope to a running server
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// logs go to stderr so json results on stdout can be piped
+	logging.Setup(os.Stderr)
+
+	shutdownTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	// interrupting the command cancels the job the same way a client disconnect does on the server
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := utils.JobContext(ctx)
+	defer cancel()
+
+	switch os.Args[1] {
+	case "adp":
+		err = runADP(ctx, os.Args[2:])
+	case "score":
+		err = runScore(ctx, os.Args[2:])
+	case "rollover":
+		err = runRollover(ctx, os.Args[2:])
+	case "ownership":
+		err = runOwnership(ctx, os.Args[2:])
+	case "analyze":
+		err = runAnalyze(ctx, os.Args[2:])
+	case "recompute":
+		err = runRecompute(ctx, os.Args[2:])
+	case "export":
+		err = runExport(ctx, os.Args[2:])
+	case "validate":
+		err = runValidate(ctx, os.Args[2:])
+	case "pubsub":
+		err = runPubSub(ctx, os.Args[2:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		err = fmt.Errorf("unknown command %q", os.Args[1])
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		cancel()
+		shutdownTracing(context.Background())
+		os.Exit(1)
+	}
+}
+
+// subcommand checks that args starts with the expected sub command and
+// returns the remaining args
+func subcommand(command string, expected string, args []string) ([]string, error) {
+	if len(args) == 0 || args[0] != expected {
+		return nil, fmt.Errorf("usage: sbs-admin %s %s", command, expected)
+	}
+	return args[1:], nil
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func runADP(ctx context.Context, args []string) error {
+	args, err := subcommand("adp", "compute", args)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("adp compute", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "calculate adp without writing it and print what would change")
+	fs.Parse(args)
+
+	utils.NewDatabaseClient()
+	summary, err := cloudfunctions.ComputeADP(ctx, *dryRun)
+	if err != nil {
+		// the summary still lists which leagues were processed, skipped and failed
+		printJSON(summary)
+		return err
+	}
+	err = printJSON(summary)
+	if err != nil {
+		return err
+	}
+	if summary.LeaguesFailed > 0 {
+		return fmt.Errorf("adp was updated without %d leagues that could not be read", summary.LeaguesFailed)
+	}
+	return nil
+}
+
+func runScore(ctx context.Context, args []string) error {
+	args, err := subcommand("score", "week", args)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("score week", flag.ExitOnError)
+	week := fs.String("week", "", "gameweek to score")
+	input := fs.String("input", "", "csv file of fantasy points per team")
+	dryRun := fs.Bool("dry-run", false, "score the cards without writing them and print what would change")
+	fs.Parse(args)
+
+	if *week == "" || *input == "" {
+		return fmt.Errorf("--week and --input are required")
+	}
+
+	file, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scores, err := cloudfunctions.ReadScoresCSV(file)
+	if err != nil {
+		return err
+	}
+
+	utils.NewDatabaseClient()
+	summary, err := cloudfunctions.ScoreDraftTokens(ctx, *week, scores, *dryRun)
+	if err != nil && ctx.Err() != nil {
+		// print how far the run got before it was stopped
+		printJSON(summary)
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(summary)
+}
+
+func runRollover(ctx context.Context, args []string) error {
+	args, err := subcommand("rollover", "week", args)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("rollover week", flag.ExitOnError)
+	week := fs.String("week", "", "gameweek to create card scores for")
+	dryRun := fs.Bool("dry-run", false, "count the card scores that would be created without writing them")
+	fs.Parse(args)
+
+	if *week == "" {
+		return fmt.Errorf("--week is required")
+	}
+
+	utils.NewDatabaseClient()
+	summary, err := cloudfunctions.RolloverWeek(ctx, *week, *dryRun)
+	if err != nil {
+		printJSON(summary)
+		return err
+	}
+	return printJSON(summary)
+}
+
+func runOwnership(ctx context.Context, args []string) error {
+	args, err := subcommand("ownership", "sync", args)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("ownership sync", flag.ExitOnError)
+	fixture := fs.String("fixture", "", "read transfers from a json fixture instead of OWNERSHIP_RPC_URL")
+	fs.Parse(args)
+
+	var source cloudfunctions.TransferSource
+	if *fixture != "" {
+		source = &cloudfunctions.FileTransferSource{Path: *fixture}
+	} else {
+		source, err = cloudfunctions.TransferSourceFromEnv()
+		if err != nil {
+			return err
+		}
+	}
+
+	utils.NewDatabaseClient()
+	summary, err := cloudfunctions.SyncOwnership(ctx, source)
+	if err != nil {
+		printJSON(summary)
+		return err
+	}
+	return printJSON(summary)
+}
+
+func runAnalyze(ctx context.Context, args []string) error {
+	args, err := subcommand("analyze", "stacks", args)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("analyze stacks", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print the analysis without publishing it to analytics/stacking")
+	fs.Parse(args)
+
+	utils.NewDatabaseClient()
+	analysis, err := cloudfunctions.AnalyzeStacking(ctx, *dryRun)
+	if err != nil {
+		printJSON(analysis)
+		return err
+	}
+	return printJSON(analysis)
+}
+
+func runRecompute(ctx context.Context, args []string) error {
+	args, err := subcommand("recompute", "season", args)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("recompute season", flag.ExitOnError)
+	through := fs.Int("through", 0, "last gameweek of the season to recompute, starting from week 1")
+	weeks := fs.String("weeks", "", "comma separated gameweek ids in season order, overrides --through. Season totals carry on from the week before the first")
+	fs.Parse(args)
+
+	gameweeks := cloudfunctions.GameweekIds(*through)
+	if *weeks != "" {
+		gameweeks = strings.Split(*weeks, ",")
+	}
+	if len(gameweeks) == 0 {
+		return fmt.Errorf("--through or --weeks is required")
+	}
+
+	utils.NewDatabaseClient()
+	summary, err := cloudfunctions.RecomputeSeason(ctx, gameweeks)
+	if err != nil {
+		printJSON(summary)
+		return err
+	}
+	err = printJSON(summary)
+	if err != nil {
+		return err
+	}
+	if summary.CardsFailed > 0 {
+		return fmt.Errorf("%d cards could not be recomputed", summary.CardsFailed)
+	}
+	return nil
+}
+
+func runExport(ctx context.Context, args []string) error {
+	args, err := subcommand("export", "league", args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf("usage: sbs-admin export league <leagueId> [--week <n>]")
+	}
+	leagueId := args[0]
+
+	fs := flag.NewFlagSet("export league", flag.ExitOnError)
+	week := fs.String("week", "", "include the card scores of this gameweek")
+	fs.Parse(args[1:])
+
+	utils.NewDatabaseClient()
+	export, err := cloudfunctions.ExportLeague(ctx, leagueId, *week)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(export)
+}
+
+func runValidate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Parse(args)
+
+	utils.NewDatabaseClient()
+	issues, err := cloudfunctions.ValidateData(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, issue := range issues {
+		fmt.Printf("%s: %s\n", issue.Path, issue.Problem)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("found %d issues", len(issues))
+	}
+
+	fmt.Println("no issues found")
+	return nil
+}
+
+// runPubSub posts a push envelope the way a pub/sub push subscription would,
+// either a sample from testdata/pubsub or one built from the flags. Reusing
+// --message-id shows the deduplication at work
+func runPubSub(ctx context.Context, args []string) error {
+	args, err := subcommand("pubsub", "push", args)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("pubsub push", flag.ExitOnError)
+	url := fs.String("url", "http://localhost:8080/pubsub/push", "push endpoint of the server")
+	file := fs.String("file", "", "envelope json file to post as is")
+	job := fs.String("job", "", "job to put in the message when no file is given")
+	week := fs.String("week", "", "gameweek of the job")
+	input := fs.String("input", "", "csv file of fantasy points to send with a scoring job")
+	messageId := fs.String("message-id", "", "message id, random when empty")
+	dryRun := fs.Bool("dry-run", false, "ask for a dry run of the job")
+	fs.Parse(args)
+
+	var body []byte
+	if *file != "" {
+		body, err = os.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+	} else {
+		if *job == "" {
+			return fmt.Errorf("--file or --job is required")
+		}
+		req := cloudfunctions.JobRequest{Job: *job, GameWeek: *week, DryRun: *dryRun}
+		if *input != "" {
+			scoresFile, err := os.Open(*input)
+			if err != nil {
+				return err
+			}
+			scores, err := cloudfunctions.ReadScoresCSV(scoresFile)
+			scoresFile.Close()
+			if err != nil {
+				return err
+			}
+			req.Scores = scores.FantasyPoints
+		}
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		if *messageId == "" {
+			*messageId = uuid.NewString()
+		}
+		body, err = json.Marshal(cloudfunctions.PubSubPushEnvelope{
+			Message: cloudfunctions.PubSubMessage{
+				Data:        data,
+				MessageId:   *messageId,
+				PublishTime: time.Now().UTC(),
+			},
+			Subscription: "projects/local/subscriptions/sbs-admin",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	fmt.Fprintln(os.Stderr, "status:", res.Status)
+	_, err = io.Copy(os.Stdout, res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("push was not acknowledged: %s", res.Status)
+	}
+	return nil
+}
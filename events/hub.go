@@ -0,0 +1,182 @@
+package events
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Event is one message on a topic. Seq numbers events of a topic in the order
+// they were published, so a client that reconnects can ask for what it missed
+type Event struct {
+	Seq  int64           `json:"seq"`
+	Type string          `json:"type"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Subscription is a live feed of a topic. Replay holds the kept events
+// published after the sequence number asked for, and Gap is set when some of
+// them were already dropped so the subscriber should reload its state. Seq is
+// the last sequence number of the topic when subscribing, which state
+// reloaded instead of replaying is current as of. Events is closed when the
+// subscriber falls too far behind or the broker closes
+type Subscription struct {
+	Replay []Event
+	Gap    bool
+	Seq    int64
+	Events <-chan Event
+	Cancel func()
+}
+
+// Broker fans events out to the subscribers of a topic. Hub keeps everything
+// in process, a broker backed by a distributed pub/sub can replace it when
+// the service runs on more than one instance
+type Broker interface {
+	Publish(topic string, eventType string, data any) (Event, error)
+	Subscribe(topic string, afterSeq int64) Subscription
+	// Retire marks a topic as finished so it is dropped once its last
+	// subscriber leaves
+	Retire(topic string)
+	Close()
+}
+
+type topic struct {
+	seq         int64
+	history     []Event
+	subscribers map[chan Event]struct{}
+	retired     bool
+}
+
+// Hub is the in process Broker. It keeps the last historySize events of every
+// topic for replay until the topic is retired and has no subscribers left
+type Hub struct {
+	lock        sync.Mutex
+	historySize int
+	topics      map[string]*topic
+	closed      bool
+}
+
+// buffered events per subscriber before it counts as too slow and is dropped
+const subscriberBuffer = 64
+
+func NewHub(historySize int) *Hub {
+	return &Hub{
+		historySize: historySize,
+		topics:      make(map[string]*topic),
+	}
+}
+
+func (h *Hub) topic(name string) *topic {
+	t, ok := h.topics[name]
+	if !ok {
+		t = &topic{subscribers: make(map[chan Event]struct{})}
+		h.topics[name] = t
+	}
+	return t
+}
+
+// dropIfIdle forgets a topic nobody is subscribed to once it is retired or
+// never had an event, which is nothing a reconnecting client could replay.
+// The caller holds the lock
+func (h *Hub) dropIfIdle(name string, t *topic) {
+	if len(t.subscribers) > 0 || !(t.retired || t.seq == 0) {
+		return
+	}
+	if h.topics[name] == t {
+		delete(h.topics, name)
+	}
+}
+
+func (h *Hub) Publish(name string, eventType string, data any) (Event, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return Event{}, nil
+	}
+
+	t := h.topic(name)
+	t.seq++
+	event := Event{Seq: t.seq, Type: eventType, Time: time.Now(), Data: raw}
+	t.history = append(t.history, event)
+	if len(t.history) > h.historySize {
+		t.history = t.history[len(t.history)-h.historySize:]
+	}
+
+	for subscriber := range t.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			// the subscriber reconnects and replays from the last event it got
+			delete(t.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+	return event, nil
+}
+
+func (h *Hub) Subscribe(name string, afterSeq int64) Subscription {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	events := make(chan Event, subscriberBuffer)
+	if h.closed {
+		close(events)
+		return Subscription{Events: events, Cancel: func() {}}
+	}
+
+	t := h.topic(name)
+	sub := Subscription{Replay: make([]Event, 0), Seq: t.seq, Events: events}
+	for _, event := range t.history {
+		if event.Seq > afterSeq {
+			sub.Replay = append(sub.Replay, event)
+		}
+	}
+	oldest := t.seq - int64(len(t.history)) + 1
+	// a sequence number past the topic's means it was numbered before this
+	// instance restarted, which is a gap as well
+	sub.Gap = (afterSeq+1 < oldest && afterSeq < t.seq) || afterSeq > t.seq
+
+	t.subscribers[events] = struct{}{}
+	sub.Cancel = func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if _, ok := t.subscribers[events]; ok {
+			delete(t.subscribers, events)
+			close(events)
+		}
+		h.dropIfIdle(name, t)
+	}
+	return sub
+}
+
+func (h *Hub) Retire(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	t, ok := h.topics[name]
+	if !ok {
+		return
+	}
+	t.retired = true
+	h.dropIfIdle(name, t)
+}
+
+// Close ends every subscription, used on shutdown so open streams return
+func (h *Hub) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.closed = true
+	for _, t := range h.topics {
+		for subscriber := range t.subscribers {
+			close(subscriber)
+		}
+		t.subscribers = make(map[chan Event]struct{})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
+)
+
+// shuttingDown flips once a termination signal arrives so /readyz fails and
+// the load balancer stops routing new requests here while jobs drain
+var shuttingDown atomic.Bool
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if utils.Db == nil {
+		http.Error(w, "database client is not initialised", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	err := utils.Db.Ping(ctx)
+	if err != nil {
+		slog.Warn("readiness check could not reach firestore", "error", err)
+		http.Error(w, "database is not reachable", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ready"))
+}
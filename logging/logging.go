@@ -0,0 +1,147 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type contextKey struct{}
+
+// cloud logging reads the level from severity and expects WARNING instead of WARN
+var severities = map[slog.Level]string{
+	slog.LevelDebug: "DEBUG",
+	slog.LevelInfo:  "INFO",
+	slog.LevelWarn:  "WARNING",
+	slog.LevelError: "ERROR",
+}
+
+// LevelFromEnv returns the level named by LOG_LEVEL (debug, info, warn or
+// error), defaulting to info
+func LevelFromEnv() slog.Level {
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// Setup installs a JSON logger writing to w as the slog default. Records use
+// the severity and message fields Cloud Logging picks up from stdout
+func Setup(w io.Writer) *slog.Logger {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: LevelFromEnv(),
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.LevelKey:
+				level := a.Value.Any().(slog.Level)
+				severity, ok := severities[level]
+				if !ok {
+					severity = level.String()
+				}
+				return slog.String("severity", severity)
+			case slog.MessageKey:
+				a.Key = "message"
+			}
+			return a
+		},
+	})
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// contextLogger returns the logger carried by ctx without any trace ids, or
+// the default logger
+func contextLogger(ctx context.Context) *slog.Logger {
+	logger, ok := ctx.Value(contextKey{}).(*slog.Logger)
+	if !ok {
+		return slog.Default()
+	}
+	return logger
+}
+
+// FromContext returns the logger carried by ctx, or the default logger. When
+// ctx holds a span its trace and span ids are added to every line
+func FromContext(ctx context.Context) *slog.Logger {
+	logger := contextLogger(ctx)
+
+	spanCtx := trace.SpanContextFromContext(ctx)
+	if !spanCtx.IsValid() {
+		return logger
+	}
+	return logger.With(traceAttrs(spanCtx)...)
+}
+
+// traceAttrs uses the fields Cloud Logging links to Cloud Trace when the
+// project is known from GOOGLE_CLOUD_PROJECT, and plain ids otherwise
+func traceAttrs(spanCtx trace.SpanContext) []any {
+	if project := os.Getenv("GOOGLE_CLOUD_PROJECT"); project != "" {
+		return []any{
+			"logging.googleapis.com/trace", "projects/" + project + "/traces/" + spanCtx.TraceID().String(),
+			"logging.googleapis.com/spanId", spanCtx.SpanID().String(),
+			"logging.googleapis.com/trace_sampled", spanCtx.IsSampled(),
+		}
+	}
+	return []any{
+		"trace_id", spanCtx.TraceID().String(),
+		"span_id", spanCtx.SpanID().String(),
+	}
+}
+
+// WithLogger returns a copy of ctx carrying logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// With returns a copy of ctx whose logger adds args to every line. The trace
+// ids are left to FromContext so nested calls inside a span do not repeat them
+func With(ctx context.Context, args ...any) context.Context {
+	return WithLogger(ctx, contextLogger(ctx).With(args...))
+}
+
+// WithRun tags every line logged under the returned context with the job name
+// and a new run id so all the lines of one scoring or ADP run can be found together
+func WithRun(ctx context.Context, job string) context.Context {
+	return With(ctx, "job", job, "run_id", uuid.NewString())
+}
+
+// Middleware attaches a logger carrying the request id set by chi's RequestID
+// middleware to the request context and logs every completed request
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := With(r.Context(), "request_id", middleware.GetReqID(r.Context()))
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		FromContext(ctx).Info("request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"bytes", ww.BytesWritten(),
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	cloudfunctions "github.com/CJPotter10/sbs-cloud-functions-api/cloud-functions"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/CJPotter10/sbs-cloud-functions-api/metrics"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
 	"github.com/CJPotter10/sbs-cloud-functions-api/utils"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -20,20 +28,142 @@ func main() {
 		port = fromEnv
 	}
 
+	logging.Setup(os.Stdout)
+
+	shutdownTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		slog.Error("error setting up tracing", "error", err)
+		os.Exit(1)
+	}
+
 	utils.NewDatabaseClient()
 
-	fmt.Printf("Starting up on http://localhost:%s\n", port)
+	slog.Info("starting up", "address", fmt.Sprintf("http://localhost:%s", port))
 
 	r := chi.NewRouter()
 
-	r.Use(middleware.Logger)
+	r.Use(middleware.RequestID)
+	r.Use(tracing.Middleware)
+	r.Use(logging.Middleware)
+	r.Use(metrics.Middleware)
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
+	r.Get("/healthz", healthz)
+	r.Get("/readyz", readyz)
+
+	r.Handle("/metrics", metrics.Handler())
 
 	r.Post("/calculateADP", cloudfunctions.CalculateADP)
 	r.Post("/scoreDraftTokens", cloudfunctions.ScoreDraftTokensEndPoint)
 
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	r.Post("/leagues", cloudfunctions.CreateLeagueEndPoint)
+	r.Get("/leagues/{leagueId}", cloudfunctions.GetLeagueEndPoint)
+	r.Post("/leagues/{leagueId}/join", cloudfunctions.JoinLeagueEndPoint)
+	r.Post("/leagues/{leagueId}/cancel", cloudfunctions.CancelLeagueEndPoint)
+
+	r.Post("/drafts/{leagueId}", cloudfunctions.CreateDraftEndPoint)
+	r.Get("/drafts/{leagueId}", cloudfunctions.GetDraftEndPoint)
+	r.Post("/drafts/{leagueId}/picks", cloudfunctions.MakePickEndPoint)
+	r.Post("/drafts/{leagueId}/finalize", cloudfunctions.FinalizeDraftEndPoint)
+	r.Get("/drafts/{leagueId}/events", cloudfunctions.DraftEventsEndPoint)
+	r.Get("/drafts/{leagueId}/queues/{ownerAddress}", cloudfunctions.GetDraftQueueEndPoint)
+	r.Put("/drafts/{leagueId}/queues/{ownerAddress}", cloudfunctions.SetDraftQueueEndPoint)
+
+	r.Get("/owners/{ownerId}/exposure", cloudfunctions.OwnerExposureEndPoint)
+
+	r.Get("/metadata/{cardId}", cloudfunctions.TokenMetadataEndPoint)
+	r.Get("/cards/{cardId}/image.svg", cloudfunctions.CardImageSVGEndPoint)
+	r.Get("/cards/{cardId}/image.png", cloudfunctions.CardImagePNGEndPoint)
+
+	r.Post("/pubsub/push", cloudfunctions.PubSubPushEndPoint)
+	r.Post("/scheduler/{job}", cloudfunctions.SchedulerEndPoint)
+
+	// cancelling the base context cancels every request context and with it
+	// the jobs still running when the shutdown timeout runs out
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	srv := &http.Server{
+		Addr:        ":" + port,
+		Handler:     r,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	// draft room streams never finish on their own so they are ended on shutdown
+	srv.RegisterOnShutdown(cloudfunctions.DraftEvents.Close)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-serverErr:
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
+	case sig := <-signals:
+		slog.Info("received signal, shutting down", "signal", sig.String())
+	}
+
+	// fail /readyz first and keep serving while the load balancer notices
+	shuttingDown.Store(true)
+	drain := drainDelay()
+	slog.Info("draining before shutdown", "delay", drain.String())
+	time.Sleep(drain)
+	shutdown(srv, cancelRequests)
+
+	// flush the spans of the jobs that just finished
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = shutdownTracing(ctx)
+	if err != nil {
+		slog.Error("error flushing traces", "error", err)
+	}
+}
+
+// drainDelay returns SHUTDOWN_DRAIN_DELAY, how long /readyz reports not ready
+// before the server stops accepting requests
+func drainDelay() time.Duration {
+	if value, err := time.ParseDuration(os.Getenv("SHUTDOWN_DRAIN_DELAY")); err == nil && value >= 0 {
+		return value
+	}
+	return 5 * time.Second
+}
+
+// shutdown stops accepting requests, waits up to SHUTDOWN_TIMEOUT for in
+// flight requests and jobs, cancels whatever is still running and then closes
+// the firestore client
+func shutdown(srv *http.Server, cancelRequests context.CancelFunc) {
+	timeout := 10 * time.Second
+	if value, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && value > 0 {
+		timeout = value
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		err = utils.Jobs.Wait(ctx)
+	}
+	if err != nil {
+		slog.Warn("jobs still running after the shutdown timeout, cancelling them", "timeout", timeout.String(), "error", err)
+		cancelRequests()
+
+		// give cancelled jobs a moment to report partial progress and return
+		waitCtx, cancelWait := context.WithTimeout(context.Background(), 2*time.Second)
+		utils.Jobs.Wait(waitCtx)
+		cancelWait()
+		srv.Close()
+	}
+
+	err = utils.Db.Close()
+	if err != nil {
+		slog.Error("error closing firestore client", "error", err)
+	}
+	slog.Info("shutdown complete")
 }
@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	cardsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sbs_cards_total",
+		Help: "Draft token cards handled by scoring runs, by result (scored, failed, skipped).",
+	}, []string{"result"})
+
+	lastRunCards = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sbs_last_scoring_run_cards",
+		Help: "Cards handled by the most recent scoring run, by result (scored, failed, skipped).",
+	}, []string{"result"})
+
+	adpLeaguesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sbs_adp_leagues_total",
+		Help: "Leagues handled by ADP runs, by result (processed, skipped, failed).",
+	}, []string{"result"})
+
+	lastRunLeagues = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sbs_last_adp_run_leagues",
+		Help: "Leagues handled by the most recent ADP run, by result (processed, skipped, failed).",
+	}, []string{"result"})
+
+	firestoreDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sbs_firestore_operation_duration_seconds",
+		Help:    "Latency of firestore operations by operation and collection.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"operation", "collection"})
+
+	firestoreErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sbs_firestore_operation_errors_total",
+		Help: "Failed firestore operations by operation and collection.",
+	}, []string{"operation", "collection"})
+
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sbs_job_duration_seconds",
+		Help:    "Duration of scoring, ADP and other jobs by job and status.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 13),
+	}, []string{"job", "status"})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sbs_http_requests_total",
+		Help: "HTTP requests by method, chi route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sbs_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and chi route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+// Handler serves every registered metric in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RecordScoringRun adds the card counts of a finished scoring run
+func RecordScoringRun(scored int, failed int, skipped int) {
+	for result, count := range map[string]int{"scored": scored, "failed": failed, "skipped": skipped} {
+		cardsTotal.WithLabelValues(result).Add(float64(count))
+		lastRunCards.WithLabelValues(result).Set(float64(count))
+	}
+}
+
+// RecordADPRun adds the league counts of a finished ADP run
+func RecordADPRun(processed int, skipped int, failed int) {
+	for result, count := range map[string]int{"processed": processed, "skipped": skipped, "failed": failed} {
+		adpLeaguesTotal.WithLabelValues(result).Add(float64(count))
+		lastRunLeagues.WithLabelValues(result).Set(float64(count))
+	}
+}
+
+// ObserveJob records how long a job took and whether it succeeded, failed or
+// was cancelled
+func ObserveJob(job string, start time.Time, err error) {
+	jobDuration.WithLabelValues(job, jobStatus(err)).Observe(time.Since(start).Seconds())
+}
+
+func jobStatus(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "cancelled"
+	}
+	return "error"
+}
+
+// ObserveFirestore records the latency of a firestore operation on a
+// collection path and counts it as an error when err is set
+func ObserveFirestore(operation string, collection string, start time.Time, err error) {
+	collection = CollectionLabel(collection)
+	firestoreDuration.WithLabelValues(operation, collection).Observe(time.Since(start).Seconds())
+	if err != nil {
+		firestoreErrors.WithLabelValues(operation, collection).Inc()
+	}
+}
+
+// CollectionLabel replaces the document ids in a collection path with {id} so
+// drafts/abc/scores/5/cards and drafts/xyz/scores/6/cards share one label
+func CollectionLabel(collection string) string {
+	segments := strings.Split(strings.Trim(collection, "/"), "/")
+	for i := 1; i < len(segments); i += 2 {
+		segments[i] = "{id}"
+	}
+	return strings.Join(segments, "/")
+}
+
+// Middleware counts and times every request by the chi route pattern it
+// matched, so path parameters do not create a label per value
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if routeCtx := chi.RouteContext(r.Context()); routeCtx != nil && routeCtx.RoutePattern() != "" {
+			route = routeCtx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,242 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type BatchWriterOptions struct {
+	// number of writes whose results are collected together
+	BatchSize int
+	// number of batches allowed to wait on their results before Set blocks the caller
+	MaxInFlight int
+	// number of times a write that failed with a transient error is tried on its own
+	MaxAttempts int
+	// delay before the first retry, doubled on every attempt after that
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultBatchWriterOptions = BatchWriterOptions{
+	BatchSize:      100,
+	MaxInFlight:    4,
+	MaxAttempts:    5,
+	InitialBackoff: 250 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// BatchWriterOptionsFromEnv returns the default options overridden by
+// FIRESTORE_BATCH_SIZE, FIRESTORE_BATCH_MAX_IN_FLIGHT and FIRESTORE_BATCH_MAX_ATTEMPTS
+func BatchWriterOptionsFromEnv() BatchWriterOptions {
+	opts := DefaultBatchWriterOptions
+	for env, field := range map[string]*int{
+		"FIRESTORE_BATCH_SIZE":          &opts.BatchSize,
+		"FIRESTORE_BATCH_MAX_IN_FLIGHT": &opts.MaxInFlight,
+		"FIRESTORE_BATCH_MAX_ATTEMPTS":  &opts.MaxAttempts,
+	} {
+		if value, err := strconv.Atoi(os.Getenv(env)); err == nil && value > 0 {
+			*field = value
+		}
+	}
+	return opts
+}
+
+type batchWrite struct {
+	collection string
+	documentId string
+	data       any
+	opts       []firestore.SetOption
+	job        *firestore.BulkWriterJob
+}
+
+func (w batchWrite) path() string {
+	return w.collection + "/" + w.documentId
+}
+
+// BatchWriteError lists every document whose write still failed after retrying
+type BatchWriteError struct {
+	Failed map[string]error
+}
+
+func (e *BatchWriteError) Error() string {
+	paths := make([]string, 0, len(e.Failed))
+	for path := range e.Failed {
+		paths = append(paths, path)
+	}
+	return fmt.Sprintf("%d document writes failed: %s", len(e.Failed), strings.Join(paths, ", "))
+}
+
+// BatchWriter queues document writes on a firestore BulkWriter, which sends
+// them in parallel without the document locks of a transaction. The results
+// are collected a batch at a time, writes that failed with a transient error
+// are tried again on their own with backoff, and Set blocks while MaxInFlight
+// batches are waiting on results so producers can not queue writes faster than
+// firestore accepts them. A document can only be written once per writer
+type BatchWriter struct {
+	db       *DatabaseConn
+	ctx      context.Context
+	opts     BatchWriterOptions
+	lock     sync.Mutex
+	bulk     *firestore.BulkWriter
+	pending  []batchWrite
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+	failed   map[string]error
+}
+
+// NewBatchWriter returns a writer whose writes run under ctx, so cancelling
+// ctx fails the writes that are still queued
+func (db *DatabaseConn) NewBatchWriter(ctx context.Context, opts BatchWriterOptions) *BatchWriter {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchWriterOptions.BatchSize
+	}
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = 1
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 1
+	}
+
+	return &BatchWriter{
+		db:       db,
+		ctx:      ctx,
+		opts:     opts,
+		bulk:     db.Client.BulkWriter(ctx),
+		pending:  make([]batchWrite, 0, opts.BatchSize),
+		inFlight: make(chan struct{}, opts.MaxInFlight),
+		failed:   make(map[string]error),
+	}
+}
+
+// Set queues a create or overwrite of collection/documentId and starts
+// collecting the results of the queued writes once a full batch has built up
+func (bw *BatchWriter) Set(collection string, documentId string, v any, opts ...firestore.SetOption) {
+	w := batchWrite{collection: collection, documentId: documentId, data: v, opts: opts}
+
+	// the bulk writer's own bookkeeping is not safe for concurrent use
+	bw.lock.Lock()
+	job, err := bw.bulk.Set(bw.db.Client.Collection(collection).Doc(documentId), v, opts...)
+	if err != nil {
+		bw.failed[w.path()] = err
+		bw.lock.Unlock()
+		return
+	}
+	w.job = job
+	bw.pending = append(bw.pending, w)
+	if len(bw.pending) < bw.opts.BatchSize {
+		bw.lock.Unlock()
+		return
+	}
+	writes := bw.pending
+	bw.pending = make([]batchWrite, 0, bw.opts.BatchSize)
+	bw.lock.Unlock()
+
+	bw.collectAsync(writes)
+}
+
+// Flush sends whatever writes are queued without waiting for a full batch.
+// Set blocks until the bulk writer has sent them
+func (bw *BatchWriter) Flush() {
+	bw.lock.Lock()
+	writes := bw.pending
+	bw.pending = make([]batchWrite, 0, bw.opts.BatchSize)
+	bw.bulk.Flush()
+	bw.lock.Unlock()
+
+	if len(writes) > 0 {
+		bw.collectAsync(writes)
+	}
+}
+
+// Close sends the queued writes, waits for every result and returns a
+// *BatchWriteError when any document could not be written
+func (bw *BatchWriter) Close() error {
+	bw.lock.Lock()
+	writes := bw.pending
+	bw.pending = nil
+	bw.bulk.End()
+	bw.lock.Unlock()
+
+	if len(writes) > 0 {
+		bw.collectAsync(writes)
+	}
+	bw.wg.Wait()
+
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+	if len(bw.failed) == 0 {
+		return nil
+	}
+	return &BatchWriteError{Failed: bw.failed}
+}
+
+func (bw *BatchWriter) collectAsync(writes []batchWrite) {
+	bw.inFlight <- struct{}{} // blocks while MaxInFlight batches are waiting on results
+	bw.wg.Add(1)
+	go func() {
+		defer func() {
+			<-bw.inFlight
+			bw.wg.Done()
+		}()
+
+		failed := bw.collect(writes)
+		if len(failed) == 0 {
+			return
+		}
+
+		logging.FromContext(bw.ctx).Error("error writing batch", "writes", len(writes), "failed", len(failed))
+		bw.lock.Lock()
+		for path, err := range failed {
+			bw.failed[path] = err
+		}
+		bw.lock.Unlock()
+	}()
+}
+
+// collect waits for the result of every write in the batch and returns the
+// writes that still failed after retrying the transient failures
+func (bw *BatchWriter) collect(writes []batchWrite) (failed map[string]error) {
+	ctx, op := startOperation(bw.ctx, "bulk_write", writes[0].collection, attribute.Int("db.writes", len(writes)))
+	defer func() {
+		var err error
+		if len(failed) > 0 {
+			err = &BatchWriteError{Failed: failed}
+		}
+		op.end(err)
+	}()
+
+	failed = make(map[string]error)
+	for _, w := range writes {
+		_, err := w.job.Results()
+		if err != nil && IsRetryable(err) && ctx.Err() == nil {
+			err = bw.retry(ctx, w)
+		}
+		if err != nil {
+			failed[w.path()] = err
+		}
+	}
+	return failed
+}
+
+// retry writes a single document that the bulk writer could not, which only
+// happens when the whole request to firestore failed
+func (bw *BatchWriter) retry(ctx context.Context, w batchWrite) error {
+	policy := RetryPolicy{
+		MaxAttempts:    bw.opts.MaxAttempts,
+		InitialBackoff: bw.opts.InitialBackoff,
+		MaxBackoff:     bw.opts.MaxBackoff,
+	}
+	return policy.Do(ctx, func(ctx context.Context) error {
+		_, err := bw.db.Client.Collection(w.collection).Doc(w.documentId).Set(ctx, w.data, w.opts...)
+		return err
+	})
+}
@@ -2,17 +2,23 @@ package utils
 
 import (
 	"context"
-	"fmt"
+	"log/slog"
+	"strings"
 
 	"cloud.google.com/go/firestore"
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	secretmanagerpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	firebase "firebase.google.com/go"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type DatabaseConn struct {
 	Client *firestore.Client
+	// retry policy for single document reads and writes
+	Retry RetryPolicy
 }
 
 var Db *DatabaseConn
@@ -25,7 +31,7 @@ func NewDatabaseClient() {
 	ctx := context.Background()
 	creds, err := getFirebaseCreds()
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("error reading firebase credentials", "error", err)
 		panic(err)
 	}
 	conf := option.WithCredentialsJSON(creds)
@@ -40,7 +46,7 @@ func NewDatabaseClient() {
 		panic(err)
 	}
 
-	Db = &DatabaseConn{client}
+	Db = &DatabaseConn{Client: client, Retry: RetryPolicyFromEnv()}
 }
 
 func getFirebaseCreds() ([]byte, error) {
@@ -69,27 +75,69 @@ func getFirebaseCreds() ([]byte, error) {
 	return res.GetPayload().Data, nil
 }
 
-func (db *DatabaseConn) ReadDocument(collection string, documentId string, v any) error {
-	ctx := context.Background()
-	snapshot, err := db.Client.Collection(collection).Doc(documentId).Get(ctx)
+func (db *DatabaseConn) ReadDocument(ctx context.Context, collection string, documentId string, v any) error {
+	var snapshot *firestore.DocumentSnapshot
+	err := db.Retry.Do(ctx, func(ctx context.Context) error {
+		ctx, op := startOperation(ctx, "read", collection, attribute.String("db.document_id", documentId))
+		var err error
+		snapshot, err = db.Client.Collection(collection).Doc(documentId).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			// a missing document is an answer, not a failed operation
+			op.end(nil)
+		} else {
+			op.end(err)
+		}
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("error when reading document at %s/%s with an error of: %v", collection, documentId, err)
+		return documentError("reading", collection+"/"+documentId, err)
 	}
 
-	snapshot.DataTo(v)
+	err = snapshot.DataTo(v)
+	if err != nil {
+		return &DocumentError{Op: "reading", Path: collection + "/" + documentId, Kind: ErrDecode, Err: err}
+	}
 	return nil
 }
 
-func (db *DatabaseConn) CreateOrUpdateDocument(collection string, documentId string, v any) error {
-	ctx := context.Background()
+func (db *DatabaseConn) CreateOrUpdateDocument(ctx context.Context, collection string, documentId string, v any) error {
 	// data, err := json.Marshal(v)
 	// if err != nil {
 	// 	return fmt.Errorf("error in marshalling the given object (%v) with error: %v", v, err)
 	// }
 
-	_, err := db.Client.Collection(collection).Doc(documentId).Set(ctx, v)
+	err := db.Retry.Do(ctx, func(ctx context.Context) error {
+		ctx, op := startOperation(ctx, "write", collection, attribute.String("db.document_id", documentId))
+		_, err := db.Client.Collection(collection).Doc(documentId).Set(ctx, v)
+		op.end(err)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("error in Updating/Creating document at %s/%s: %v", collection, documentId, err)
+		return documentError("writing", collection+"/"+documentId, err)
 	}
 	return nil
 }
+
+// collectionPath returns the path of the collection a document belongs to
+// relative to the database root, such as drafts/abc/scores/5/cards
+func collectionPath(doc *firestore.DocumentRef) string {
+	path := doc.Parent.Path
+	if i := strings.Index(path, "/documents/"); i >= 0 {
+		return path[i+len("/documents/"):]
+	}
+	return path
+}
+
+// Ping checks that firestore can be reached with the current credentials. A
+// missing document still proves the round trip worked
+func (db *DatabaseConn) Ping(ctx context.Context) error {
+	_, err := db.Client.Collection("health").Doc("readyz").Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return err
+	}
+	return nil
+}
+
+func (db *DatabaseConn) Close() error {
+	return db.Client.Close()
+}
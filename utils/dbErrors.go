@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// kinds of DocumentError, matched with errors.Is
+var (
+	ErrNotFound  = errors.New("document not found")
+	ErrDecode    = errors.New("document could not be decoded")
+	ErrTransport = errors.New("database request failed")
+)
+
+// DocumentError is returned by the DatabaseConn document methods. Kind is one
+// of ErrNotFound, ErrDecode or ErrTransport and Err is the underlying cause
+type DocumentError struct {
+	Op   string
+	Path string
+	Kind error
+	Err  error
+}
+
+func (e *DocumentError) Error() string {
+	return fmt.Sprintf("error when %s document at %s (%v): %v", e.Op, e.Path, e.Kind, e.Err)
+}
+
+func (e *DocumentError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *DocumentError) Unwrap() error {
+	return e.Err
+}
+
+// documentError wraps a failed firestore call, classifying it by grpc code
+func documentError(op string, path string, err error) error {
+	kind := ErrTransport
+	if status.Code(err) == codes.NotFound {
+		kind = ErrNotFound
+	}
+	return &DocumentError{Op: op, Path: path, Kind: kind, Err: err}
+}
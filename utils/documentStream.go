@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/metrics"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultPageSize = 300
+	defaultWorkers  = 40
+)
+
+var errStreamStopped = errors.New("document stream stopped")
+
+// PageSizeFromEnv returns FIRESTORE_PAGE_SIZE or the default page size
+func PageSizeFromEnv() int {
+	if value, err := strconv.Atoi(os.Getenv("FIRESTORE_PAGE_SIZE")); err == nil && value > 0 {
+		return value
+	}
+	return defaultPageSize
+}
+
+// WorkersFromEnv returns WORKER_POOL_SIZE or the default number of workers
+func WorkersFromEnv() int {
+	if value, err := strconv.Atoi(os.Getenv("WORKER_POOL_SIZE")); err == nil && value > 0 {
+		return value
+	}
+	return defaultWorkers
+}
+
+// StreamDocuments pages through the documents matched by query in document id
+// order, using the last document of each page as the cursor for the next one,
+// and calls fn for every document as it arrives. Only one page is held in
+// memory at a time. Streaming stops at the first error returned by fn
+func (db *DatabaseConn) StreamDocuments(ctx context.Context, query firestore.Query, pageSize int, fn func(*firestore.DocumentSnapshot) error) error {
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+
+	query = query.OrderBy(firestore.DocumentID, firestore.Asc).Limit(pageSize)
+	var cursor *firestore.DocumentSnapshot
+	for {
+		page := query
+		if cursor != nil {
+			page = query.StartAfter(cursor)
+		}
+
+		count, last, err := streamPage(ctx, page, fn)
+		if err != nil {
+			return err
+		}
+		if count < pageSize {
+			return nil
+		}
+		cursor = last
+	}
+}
+
+// streamPage calls fn for every document of one page and returns how many
+// documents the page held and the last of them, traced as a single span
+func streamPage(ctx context.Context, page firestore.Query, fn func(*firestore.DocumentSnapshot) error) (count int, last *firestore.DocumentSnapshot, err error) {
+	ctx, span := tracing.Start(ctx, "firestore.query_page", attribute.String("db.system", "firestore"))
+	collection := "unknown"
+	defer func() {
+		span.SetAttributes(attribute.String("db.collection", metrics.CollectionLabel(collection)), attribute.Int("db.documents", count))
+		tracing.End(span, err)
+	}()
+
+	iter := page.Documents(ctx)
+	defer iter.Stop()
+	for {
+		start := time.Now()
+		snapshot, err := iter.Next()
+		if err == iterator.Done {
+			return count, last, nil
+		}
+		if err != nil {
+			metrics.ObserveFirestore("query", collection, start, err)
+			return count, last, err
+		}
+		collection = collectionPath(snapshot.Ref)
+		metrics.ObserveFirestore("query", collection, start, nil)
+		count++
+		last = snapshot
+
+		err = fn(snapshot)
+		if err != nil {
+			return count, last, err
+		}
+	}
+}
+
+// ForEachDocument streams the documents matched by query to a pool of workers
+// goroutines that call fn. The stream waits while every worker is busy so
+// memory stays bounded by the page size and the worker count. The first error
+// from the stream or from fn stops new documents from being handed out and is
+// returned once the running workers have finished. Cancelling ctx stops the
+// stream the same way and returns the context error
+func (db *DatabaseConn) ForEachDocument(ctx context.Context, query firestore.Query, pageSize int, workers int, fn func(*firestore.DocumentSnapshot) error) error {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	snapshots := make(chan *firestore.DocumentSnapshot)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var firstErr error
+	var errLock sync.Mutex
+
+	fail := func(err error) {
+		errLock.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		errLock.Unlock()
+		stopOnce.Do(func() { close(stop) })
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for snapshot := range snapshots {
+				err := fn(snapshot)
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	err := db.StreamDocuments(ctx, query, pageSize, func(snapshot *firestore.DocumentSnapshot) error {
+		select {
+		case snapshots <- snapshot:
+			return nil
+		case <-stop:
+			return errStreamStopped
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	if err != nil && err != errStreamStopped {
+		fail(err)
+	}
+
+	close(snapshots)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"github.com/CJPotter10/sbs-cloud-functions-api/metrics"
+	"github.com/CJPotter10/sbs-cloud-functions-api/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// operation is a single firestore call being timed for the metrics and traced
+// as a span
+type operation struct {
+	name       string
+	collection string
+	start      time.Time
+	span       trace.Span
+}
+
+func startOperation(ctx context.Context, name string, collection string, attrs ...attribute.KeyValue) (context.Context, *operation) {
+	attrs = append(attrs,
+		attribute.String("db.system", "firestore"),
+		attribute.String("db.operation", name),
+		attribute.String("db.collection", metrics.CollectionLabel(collection)),
+	)
+	ctx, span := tracing.Start(ctx, "firestore."+name, attrs...)
+	return ctx, &operation{
+		name:       name,
+		collection: collection,
+		start:      time.Now(),
+		span:       span,
+	}
+}
+
+func (op *operation) end(err error) {
+	metrics.ObserveFirestore(op.name, op.collection, op.start, err)
+	tracing.End(op.span, err)
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultJobTimeout = 55 * time.Minute
+
+// JobTimeoutFromEnv returns JOB_TIMEOUT parsed as a duration such as "30m",
+// or the default which stays under the 60 minute Cloud Run request limit
+func JobTimeoutFromEnv() time.Duration {
+	if value, err := time.ParseDuration(os.Getenv("JOB_TIMEOUT")); err == nil && value > 0 {
+		return value
+	}
+	return defaultJobTimeout
+}
+
+// JobTracker counts the jobs that are running so shutdown can wait for them
+type JobTracker struct {
+	wg sync.WaitGroup
+}
+
+// Jobs tracks every job started through JobContext
+var Jobs = &JobTracker{}
+
+// Start registers a running job and returns the func that marks it finished
+func (t *JobTracker) Start() func() {
+	t.wg.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(t.wg.Done)
+	}
+}
+
+// Wait blocks until every running job has finished or ctx is done
+func (t *JobTracker) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// JobContext derives the context a scoring or ADP run works under from the
+// request or command context, adding the overall job deadline. The job counts
+// as running for graceful shutdown until the returned cancel func is called
+func JobContext(parent context.Context) (context.Context, context.CancelFunc) {
+	finished := Jobs.Start()
+	ctx, cancel := context.WithTimeout(parent, JobTimeoutFromEnv())
+	return ctx, func() {
+		cancel()
+		finished()
+	}
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const processedMessagesCollection = "processedMessages"
+
+const (
+	MessageProcessing = "processing"
+	MessageDone       = "done"
+	MessageFailed     = "failed"
+)
+
+type ProcessedMessage struct {
+	MessageId  string
+	Status     string
+	Source     string
+	Error      string
+	ReceivedAt time.Time
+	UpdatedAt  time.Time
+}
+
+// ClaimMessage records that messageId is being processed and reports whether
+// this delivery should run it. A message already processing or done is a
+// duplicate delivery, while one that failed, or whose processing outlived the
+// job timeout because the instance died, may be claimed again so the
+// redelivery retries it
+func (db *DatabaseConn) ClaimMessage(ctx context.Context, messageId string, source string) (claimed bool, err error) {
+	ctx, op := startOperation(ctx, "claim_message", processedMessagesCollection, attribute.String("db.document_id", messageId))
+	defer func() {
+		op.end(err)
+	}()
+
+	ref := db.Client.Collection(processedMessagesCollection).Doc(messageId)
+	err = db.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+		snapshot, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		now := time.Now()
+		message := ProcessedMessage{
+			MessageId:  messageId,
+			Status:     MessageProcessing,
+			Source:     source,
+			ReceivedAt: now,
+			UpdatedAt:  now,
+		}
+		if snapshot != nil && snapshot.Exists() {
+			var existing ProcessedMessage
+			err = snapshot.DataTo(&existing)
+			if err != nil {
+				return err
+			}
+			stale := existing.Status == MessageProcessing && now.Sub(existing.UpdatedAt) > JobTimeoutFromEnv()
+			if existing.Status != MessageFailed && !stale {
+				return nil
+			}
+			message.ReceivedAt = existing.ReceivedAt
+		}
+
+		claimed = true
+		return tx.Set(ref, message)
+	})
+	return claimed, err
+}
+
+// CompleteMessage marks a claimed message as done, or as failed with jobErr
+func (db *DatabaseConn) CompleteMessage(ctx context.Context, messageId string, jobErr error) (err error) {
+	ctx, op := startOperation(ctx, "complete_message", processedMessagesCollection, attribute.String("db.document_id", messageId))
+	defer func() {
+		op.end(err)
+	}()
+
+	updates := []firestore.Update{
+		{Path: "Status", Value: MessageDone},
+		{Path: "Error", Value: ""},
+		{Path: "UpdatedAt", Value: time.Now()},
+	}
+	if jobErr != nil {
+		updates[0].Value = MessageFailed
+		updates[1].Value = jobErr.Error()
+	}
+
+	_, err = db.Client.Collection(processedMessagesCollection).Doc(messageId).Update(ctx, updates)
+	return err
+}
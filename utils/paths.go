@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// top level collections
+const (
+	DraftsCollection        = "drafts"
+	DraftTokensCollection   = "draftTokens"
+	PlayerStatsCollection   = "playerStats2023"
+	FantasyPointsCollection = "fantasyPoints"
+	RefundsCollection       = "refunds"
+	SyncCursorsCollection   = "syncCursors"
+	AnalyticsCollection     = "analytics"
+)
+
+// DocumentPath is a document in a collection, where the collection may be
+// nested under other documents such as drafts/abc/scores/5/cards
+type DocumentPath struct {
+	Collection string
+	DocumentId string
+}
+
+func (p DocumentPath) String() string {
+	return p.Collection + "/" + p.DocumentId
+}
+
+// Validate checks that no segment of the path is empty and that the
+// collection has an odd number of segments, which catches ids containing a slash
+func (p DocumentPath) Validate() error {
+	if err := validateCollectionPath(p.Collection); err != nil {
+		return err
+	}
+	if p.DocumentId == "" || strings.Contains(p.DocumentId, "/") {
+		return fmt.Errorf("invalid document id %q in %s", p.DocumentId, p.Collection)
+	}
+	return nil
+}
+
+func validateCollectionPath(collection string) error {
+	segments := strings.Split(collection, "/")
+	if len(segments)%2 == 0 {
+		return fmt.Errorf("invalid collection path %q: collections have an odd number of segments", collection)
+	}
+	for _, segment := range segments {
+		if segment == "" {
+			return fmt.Errorf("invalid collection path %q: empty segment", collection)
+		}
+	}
+	return nil
+}
+
+// DraftPath is the league document of a draft
+func DraftPath(leagueId string) DocumentPath {
+	return DocumentPath{DraftsCollection, leagueId}
+}
+
+// DraftStateCollection holds the state documents of a draft
+func DraftStateCollection(leagueId string) string {
+	return DraftsCollection + "/" + leagueId + "/state"
+}
+
+// DraftSummaryPath is the DraftSummary of every pick made in a draft
+func DraftSummaryPath(leagueId string) DocumentPath {
+	return DocumentPath{DraftStateCollection(leagueId), "summary"}
+}
+
+// CardScoresCollection holds the CardScores of every card in a league for a gameweek
+func CardScoresCollection(leagueId string, gameweek string) string {
+	return DraftsCollection + "/" + leagueId + "/scores/" + gameweek + "/cards"
+}
+
+func CardScoresPath(leagueId string, gameweek string, cardId string) DocumentPath {
+	return DocumentPath{CardScoresCollection(leagueId, gameweek), cardId}
+}
+
+func DraftTokenPath(cardId string) DocumentPath {
+	return DocumentPath{DraftTokensCollection, cardId}
+}
+
+// PlayerMapPath is the player stats map the ADP calculator reads from
+func PlayerMapPath() DocumentPath {
+	return DocumentPath{PlayerStatsCollection, "playerMap"}
+}
+
+// NewPlayerMapPath is the player stats map the ADP calculator writes to
+func NewPlayerMapPath() DocumentPath {
+	return DocumentPath{PlayerStatsCollection, "newPlayerMap"}
+}
+
+func FantasyPointsPath(gameweek string) DocumentPath {
+	return DocumentPath{FantasyPointsCollection, gameweek}
+}
+
+// DraftQueuePath is the ranked autopick queue of an owner in a draft
+func DraftQueuePath(leagueId string, ownerAddress string) DocumentPath {
+	return DocumentPath{DraftsCollection + "/" + leagueId + "/queues", ownerAddress}
+}
+
+// DraftInfoPath is the DraftState the draft engine keeps next to the summary
+func DraftInfoPath(leagueId string) DocumentPath {
+	return DocumentPath{DraftStateCollection(leagueId), "info"}
+}
+
+// RefundPath is the refund owed to an owner for a cancelled league
+func RefundPath(leagueId string, ownerId string) DocumentPath {
+	return DocumentPath{RefundsCollection, leagueId + "-" + ownerId}
+}
+
+// TransferRecordPath is one on-chain transfer in the history of a draft token
+func TransferRecordPath(cardId string, txHash string, logIndex uint64) DocumentPath {
+	return DocumentPath{DraftTokensCollection + "/" + cardId + "/transfers", fmt.Sprintf("%s-%d", txHash, logIndex)}
+}
+
+// SyncCursorPath is the last block a chain sync has applied
+func SyncCursorPath(name string) DocumentPath {
+	return DocumentPath{SyncCursorsCollection, name}
+}
+
+// StackingAnalysisPath is the latest published team stacking analysis
+func StackingAnalysisPath() DocumentPath {
+	return DocumentPath{AnalyticsCollection, "stacking"}
+}
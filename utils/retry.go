@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type RetryPolicy struct {
+	// number of times an operation is tried, including the first
+	MaxAttempts int
+	// delay before the first retry, doubled on every attempt after that
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+}
+
+// RetryPolicyFromEnv returns the default policy with FIRESTORE_MAX_ATTEMPTS
+// and FIRESTORE_INITIAL_BACKOFF applied
+func RetryPolicyFromEnv() RetryPolicy {
+	policy := DefaultRetryPolicy
+	if value, err := strconv.Atoi(os.Getenv("FIRESTORE_MAX_ATTEMPTS")); err == nil && value > 0 {
+		policy.MaxAttempts = value
+	}
+	if value, err := time.ParseDuration(os.Getenv("FIRESTORE_INITIAL_BACKOFF")); err == nil && value > 0 {
+		policy.InitialBackoff = value
+	}
+	return policy
+}
+
+// IsRetryable reports whether err is a transient firestore failure that may
+// succeed when tried again
+func IsRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Aborted, codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// Do calls fn until it succeeds, returns an error that is not retryable or
+// runs out of attempts. Waits use exponential backoff with full jitter so
+// callers that failed together do not retry together
+func (p RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var err error
+	backoff := p.InitialBackoff
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = fn(ctx)
+		if err == nil || !IsRetryable(err) || attempt == maxAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		logging.FromContext(ctx).Warn("retrying database operation", "wait", wait.String(), "attempt", attempt, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+	return err
+}
@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/CJPotter10/sbs-cloud-functions-api/logging"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const runLocksCollection = "runLocks"
+
+const (
+	defaultLockTTL   = 2 * time.Minute
+	lockPollInterval = 5 * time.Second
+)
+
+// ErrLockHeld is matched by errors.Is when a run lock belongs to another run
+var ErrLockHeld = errors.New("run lock is held by another run")
+
+type LockHeldError struct {
+	Key       string
+	Owner     string
+	ExpiresAt time.Time
+}
+
+func (e *LockHeldError) Error() string {
+	return fmt.Sprintf("run lock %s is held by %s until %s", e.Key, e.Owner, e.ExpiresAt.Format(time.RFC3339))
+}
+
+func (e *LockHeldError) Is(target error) bool {
+	return target == ErrLockHeld
+}
+
+type RunLockRecord struct {
+	Key         string
+	Owner       string
+	AcquiredAt  time.Time
+	HeartbeatAt time.Time
+	ExpiresAt   time.Time
+}
+
+// RunLock is a held lease on a run lock. A heartbeat keeps extending it until
+// Release is called. If the heartbeat finds the lease was taken over the
+// context returned with it is cancelled so the run stops writing
+type RunLock struct {
+	db       *DatabaseConn
+	key      string
+	owner    string
+	ttl      time.Duration
+	cancel   context.CancelFunc
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// LockTTLFromEnv returns RUN_LOCK_TTL or the default lease length
+func LockTTLFromEnv() time.Duration {
+	if value, err := time.ParseDuration(os.Getenv("RUN_LOCK_TTL")); err == nil && value > 0 {
+		return value
+	}
+	return defaultLockTTL
+}
+
+// LockWaitFromEnv returns RUN_LOCK_WAIT, how long a run waits in line for a
+// held lock before giving up. Zero, the default, rejects the run right away
+func LockWaitFromEnv() time.Duration {
+	if value, err := time.ParseDuration(os.Getenv("RUN_LOCK_WAIT")); err == nil && value > 0 {
+		return value
+	}
+	return 0
+}
+
+func lockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return host + "/" + uuid.NewString()
+}
+
+// AcquireRunLock takes the lease on key for a new owner. A lease whose
+// heartbeat stopped past its expiry is taken over. While the lease is held by
+// a live run it waits up to wait, polling, and then returns a *LockHeldError
+func (db *DatabaseConn) AcquireRunLock(ctx context.Context, key string, ttl time.Duration, wait time.Duration) (context.Context, *RunLock, error) {
+	owner := lockOwner()
+	deadline := time.Now().Add(wait)
+	for {
+		err := db.tryAcquireRunLock(ctx, key, owner, ttl)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrLockHeld) || time.Now().Add(lockPollInterval).After(deadline) {
+			return ctx, nil, err
+		}
+
+		logging.FromContext(ctx).Info("waiting for run lock", "key", key, "error", err)
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return ctx, nil, ctx.Err()
+		}
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	lock := &RunLock{
+		db:     db,
+		key:    key,
+		owner:  owner,
+		ttl:    ttl,
+		cancel: cancel,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go lock.heartbeat(lockCtx)
+
+	logging.FromContext(ctx).Info("acquired run lock", "key", key, "owner", owner)
+	return lockCtx, lock, nil
+}
+
+func (db *DatabaseConn) tryAcquireRunLock(ctx context.Context, key string, owner string, ttl time.Duration) (err error) {
+	ctx, op := startOperation(ctx, "acquire_lock", runLocksCollection, attribute.String("db.document_id", key))
+	defer func() {
+		if errors.Is(err, ErrLockHeld) {
+			op.end(nil)
+			return
+		}
+		op.end(err)
+	}()
+
+	ref := db.Client.Collection(runLocksCollection).Doc(key)
+	return db.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		now := time.Now()
+		if snapshot != nil && snapshot.Exists() {
+			var existing RunLockRecord
+			err = snapshot.DataTo(&existing)
+			if err != nil {
+				return err
+			}
+			if existing.ExpiresAt.After(now) {
+				return &LockHeldError{Key: key, Owner: existing.Owner, ExpiresAt: existing.ExpiresAt}
+			}
+			logging.FromContext(ctx).Warn("recovering expired run lock", "key", key, "previous_owner", existing.Owner, "expired_at", existing.ExpiresAt)
+		}
+
+		return tx.Set(ref, RunLockRecord{
+			Key:         key,
+			Owner:       owner,
+			AcquiredAt:  now,
+			HeartbeatAt: now,
+			ExpiresAt:   now.Add(ttl),
+		})
+	})
+}
+
+func (lock *RunLock) heartbeat(ctx context.Context) {
+	defer close(lock.done)
+	ticker := time.NewTicker(lock.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := lock.extend(ctx)
+			if errors.Is(err, ErrLockHeld) {
+				logging.FromContext(ctx).Error("lost run lock, cancelling the run", "key", lock.key, "error", err)
+				lock.cancel()
+				return
+			}
+			if err != nil {
+				// the lease is still ours until it expires, so try again on the next tick
+				logging.FromContext(ctx).Warn("error extending run lock", "key", lock.key, "error", err)
+			}
+		}
+	}
+}
+
+func (lock *RunLock) extend(ctx context.Context) (err error) {
+	ctx, op := startOperation(ctx, "extend_lock", runLocksCollection, attribute.String("db.document_id", lock.key))
+	defer func() {
+		op.end(err)
+	}()
+
+	ref := lock.db.Client.Collection(runLocksCollection).Doc(lock.key)
+	return lock.db.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var existing RunLockRecord
+		snapshot, err := tx.Get(ref)
+		if err == nil {
+			err = snapshot.DataTo(&existing)
+		}
+		if err != nil {
+			return err
+		}
+		if existing.Owner != lock.owner {
+			return &LockHeldError{Key: lock.key, Owner: existing.Owner, ExpiresAt: existing.ExpiresAt}
+		}
+
+		now := time.Now()
+		return tx.Update(ref, []firestore.Update{
+			{Path: "HeartbeatAt", Value: now},
+			{Path: "ExpiresAt", Value: now.Add(lock.ttl)},
+		})
+	})
+}
+
+// Release stops the heartbeat and deletes the lease if it is still ours. It
+// runs on its own context so a cancelled run still frees its lock
+func (lock *RunLock) Release(ctx context.Context) (err error) {
+	lock.stopOnce.Do(func() { close(lock.stop) })
+	<-lock.done
+	defer lock.cancel()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	ctx, op := startOperation(ctx, "release_lock", runLocksCollection, attribute.String("db.document_id", lock.key))
+	defer func() {
+		op.end(err)
+	}()
+
+	ref := lock.db.Client.Collection(runLocksCollection).Doc(lock.key)
+	return lock.db.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var existing RunLockRecord
+		snapshot, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err == nil {
+			err = snapshot.DataTo(&existing)
+		}
+		if err != nil {
+			return err
+		}
+		if existing.Owner != lock.owner {
+			return nil
+		}
+		return tx.Delete(ref)
+	})
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"context"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Get reads the document at path into a new T
+func Get[T any](ctx context.Context, db *DatabaseConn, path DocumentPath) (T, error) {
+	var v T
+	err := path.Validate()
+	if err != nil {
+		return v, err
+	}
+	err = db.ReadDocument(ctx, path.Collection, path.DocumentId, &v)
+	return v, err
+}
+
+// Set creates or replaces the document at path with v
+func Set[T any](ctx context.Context, db *DatabaseConn, path DocumentPath, v T) error {
+	err := path.Validate()
+	if err != nil {
+		return err
+	}
+	return db.CreateOrUpdateDocument(ctx, path.Collection, path.DocumentId, v)
+}
+
+// List reads every document of a collection. It holds the whole collection in
+// memory so it is meant for small collections, use ForEachDocument otherwise
+func List[T any](ctx context.Context, db *DatabaseConn, collection string) ([]T, error) {
+	err := validateCollectionPath(collection)
+	if err != nil {
+		return nil, err
+	}
+	return Query[T](ctx, db, db.Client.Collection(collection).Query)
+}
+
+// Query reads every document matched by query, paging through the results
+func Query[T any](ctx context.Context, db *DatabaseConn, query firestore.Query) ([]T, error) {
+	results := make([]T, 0)
+	err := db.StreamDocuments(ctx, query, PageSizeFromEnv(), func(snapshot *firestore.DocumentSnapshot) error {
+		var v T
+		err := snapshot.DataTo(&v)
+		if err != nil {
+			return &DocumentError{Op: "reading", Path: collectionPath(snapshot.Ref) + "/" + snapshot.Ref.ID, Kind: ErrDecode, Err: err}
+		}
+		results = append(results, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Doc returns the firestore reference of the document at path
+func (db *DatabaseConn) Doc(path DocumentPath) *firestore.DocumentRef {
+	return db.Client.Collection(path.Collection).Doc(path.DocumentId)
+}
+
+// RunTransaction runs fn in a firestore transaction traced and timed as an
+// operation on collection. Firestore retries fn itself when it is contended
+func (db *DatabaseConn) RunTransaction(ctx context.Context, collection string, fn func(ctx context.Context, tx *firestore.Transaction) error) (err error) {
+	ctx, op := startOperation(ctx, "transaction", collection)
+	defer func() {
+		op.end(err)
+	}()
+	return db.Client.RunTransaction(ctx, fn)
+}
+
+// TxGet reads the document at path into a new T inside a transaction
+func TxGet[T any](tx *firestore.Transaction, db *DatabaseConn, path DocumentPath) (T, error) {
+	var v T
+	err := path.Validate()
+	if err != nil {
+		return v, err
+	}
+	snapshot, err := tx.Get(db.Doc(path))
+	if err != nil {
+		return v, documentError("reading", path.String(), err)
+	}
+	err = snapshot.DataTo(&v)
+	if err != nil {
+		return v, &DocumentError{Op: "reading", Path: path.String(), Kind: ErrDecode, Err: err}
+	}
+	return v, nil
+}
+
+// TxSet creates or replaces the document at path inside a transaction
+func TxSet[T any](tx *firestore.Transaction, db *DatabaseConn, path DocumentPath, v T) error {
+	err := path.Validate()
+	if err != nil {
+		return err
+	}
+	return tx.Set(db.Doc(path), v)
+}